@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"go.mau.fi/whatsmeow/types"
+	"gopkg.in/yaml.v3"
+)
+
+// keyACL restricts what an API key may do, an empty list allows everything.
+type keyACL struct {
+	Key string `json:"key" yaml:"key"`
+	// Endpoints are path patterns such as "/send" or "/send/*".
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+	// Destinations are patterns matched against the full JID or the user
+	// part of it, such as "6012*" or "*@g.us".
+	Destinations []string `json:"destinations" yaml:"destinations"`
+	// Sessions are the names of the sessions the key may use.
+	Sessions []string `json:"sessions" yaml:"sessions"`
+	// ContactsOnly limits sends to users in the contact store, it defaults
+	// to -contacts-only.
+	ContactsOnly *bool `json:"contactsOnly" yaml:"contactsOnly"`
+}
+
+// fullAccess is granted to the server key.
+var fullAccess = &keyACL{}
+
+// loadKeys reads the JSON or YAML list of additional keys, by file
+// extension.
+func loadKeys(file string) ([]*keyACL, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var acls []*keyACL
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &acls)
+	default:
+		err = json.Unmarshal(data, &acls)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid keys file %s: %w", file, err)
+	}
+	for i, acl := range acls {
+		if acl.Key == "" {
+			return nil, fmt.Errorf("invalid keys file %s: entry %d has no key", file, i)
+		}
+	}
+	return acls, nil
+}
+
+// authorize resolves key to its permissions, it returns nil if the key is
+// unknown or may not use the endpoint of r on the session s. Without a key
+// parameter the key may come as the password of Basic auth, the user name is
+// ignored.
+func authorize(s *session, r *http.Request, key string) *keyACL {
+	if key == "" {
+		if _, password, ok := r.BasicAuth(); ok {
+			key = password
+		}
+	}
+	current := currentSettings()
+	if safeEql(key, current.serverKey) {
+		return fullAccess
+	}
+	for _, acl := range current.keyACLs {
+		if !safeEql(key, acl.Key) {
+			continue
+		}
+		if !matchAny(acl.Endpoints, r.URL.Path) || !matchAny(acl.Sessions, s.name) {
+			return nil
+		}
+		return acl
+	}
+	return nil
+}
+
+// contactsOnly tells whether the key may only send to contacts.
+func (acl *keyACL) contactsOnly() bool {
+	if acl.ContactsOnly != nil {
+		return *acl.ContactsOnly
+	}
+	return contactsOnly
+}
+
+func (acl *keyACL) allowsDestination(jid types.JID) bool {
+	if len(acl.Destinations) == 0 {
+		return true
+	}
+	return matchAny(acl.Destinations, jid.String()) || matchAny(acl.Destinations, jid.User)
+}
+
+// matchAny reports whether value matches one of the patterns, or whether
+// there are no patterns at all.
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// opusMimetype is the only audio format WhatsApp plays as a voice note.
+const opusMimetype = "audio/ogg; codecs=opus"
+
+var errNotOpus = errors.New("voice notes must be OGG/Opus audio")
+
+// opusDuration walks the pages of an OGG/Opus stream and returns its length
+// in whole seconds, rounded up. Opus always counts granules at 48kHz, minus
+// the pre-skip announced in the OpusHead packet.
+func opusDuration(data []byte) (uint32, error) {
+	var preSkip, granule uint64
+	first := true
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 27 || !bytes.Equal(data[pos:pos+4], []byte("OggS")) {
+			return 0, errNotOpus
+		}
+		segments := int(data[pos+26])
+		header := pos + 27 + segments
+		if header > len(data) {
+			return 0, errNotOpus
+		}
+		size := 0
+		for _, segment := range data[pos+27 : header] {
+			size += int(segment)
+		}
+		if header+size > len(data) {
+			return 0, errNotOpus
+		}
+		body := data[header : header+size]
+		if first {
+			if len(body) < 19 || !bytes.HasPrefix(body, []byte("OpusHead")) {
+				return 0, errNotOpus
+			}
+			preSkip = uint64(binary.LittleEndian.Uint16(body[10:12]))
+			first = false
+		}
+		// pages on which no packet ends carry a granule position of -1
+		if g := binary.LittleEndian.Uint64(data[pos+6 : pos+14]); g != ^uint64(0) {
+			granule = g
+		}
+		pos = header + size
+	}
+	if first {
+		return 0, errNotOpus
+	}
+	if granule <= preSkip {
+		return 0, nil
+	}
+	return uint32((granule - preSkip + 47999) / 48000), nil
+}
+
+func handleSendAudio(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		data, fileName, err := readMedia(r, "audio", req.Audio)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		seconds, opusErr := opusDuration(data)
+		mimetype := req.Mimetype
+		if mimetype == "" && opusErr == nil {
+			mimetype = opusMimetype
+		}
+		if mimetype == "" && fileName != "" {
+			mimetype = mime.TypeByExtension(filepath.Ext(fileName))
+		}
+		if mimetype == "" {
+			mimetype = http.DetectContentType(data)
+		}
+		if req.PTT && opusErr != nil {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = w.Write([]byte(opusErr.Error()))
+			return
+		}
+		if req.PTT {
+			// WhatsApp checks the codec parameter as well
+			mimetype = opusMimetype
+		} else if !strings.HasPrefix(mimetype, "audio/") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = w.Write([]byte("unsupported audio type " + mimetype))
+			return
+		}
+		ctx, cancel := sendContext(r.Context())
+		defer cancel()
+		uploaded, err := sess.upload(ctx, data, whatsmeow.MediaAudio)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		audio := &proto.AudioMessage{
+			Url:           gproto.String(uploaded.URL),
+			DirectPath:    gproto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      gproto.String(mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    gproto.Uint64(uploaded.FileLength),
+			Ptt:           gproto.Bool(req.PTT),
+		}
+		result := map[string]interface{}{}
+		if opusErr == nil {
+			audio.Seconds = gproto.Uint32(seconds)
+			result["seconds"] = seconds
+		}
+		resp, attempts, err := sess.send(ctx, jid, &proto.Message{AudioMessage: audio})
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		result["id"] = resp.ID
+		result["timestamp"] = resp.Timestamp.Unix()
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"golang.org/x/crypto/scrypt"
+)
+
+// container is the whatsmeow device store.
+var container *sqlstore.Container
+
+// backupVersion changes whenever the layout of backups does.
+const backupVersion = 1
+
+// deviceTables are the whatsmeow tables holding the state of a device along
+// with the column naming the device, parents come before their children.
+var deviceTables = []struct {
+	name, owner string
+}{
+	{"whatsmeow_device", "jid"},
+	{"whatsmeow_identity_keys", "our_jid"},
+	{"whatsmeow_pre_keys", "jid"},
+	{"whatsmeow_sessions", "our_jid"},
+	{"whatsmeow_sender_keys", "our_jid"},
+	{"whatsmeow_app_state_sync_keys", "jid"},
+	{"whatsmeow_app_state_version", "jid"},
+	{"whatsmeow_app_state_mutation_macs", "jid"},
+	{"whatsmeow_contacts", "our_jid"},
+	{"whatsmeow_chat_settings", "our_jid"},
+	{"whatsmeow_message_secrets", "our_jid"},
+	{"whatsmeow_privacy_tokens", "our_jid"},
+}
+
+// backupCell is a column value, JSON alone would lose the difference
+// between text and binary columns. A cell with no field set is NULL.
+type backupCell struct {
+	Bytes []byte  `json:"b,omitempty"`
+	Int   *int64  `json:"i,omitempty"`
+	Text  *string `json:"s,omitempty"`
+	Bool  *bool   `json:"t,omitempty"`
+}
+
+func (c backupCell) value() interface{} {
+	switch {
+	case c.Bytes != nil:
+		return c.Bytes
+	case c.Int != nil:
+		return *c.Int
+	case c.Text != nil:
+		return *c.Text
+	case c.Bool != nil:
+		return *c.Bool
+	}
+	return nil
+}
+
+type deviceBackup struct {
+	Version int                                `json:"version"`
+	JID     string                             `json:"jid"`
+	Created int64                              `json:"created"`
+	Tables  map[string][]map[string]backupCell `json:"tables"`
+}
+
+// exportDevice reads every row belonging to the device.
+func exportDevice(jid types.JID) (*deviceBackup, error) {
+	backup := &deviceBackup{
+		Version: backupVersion,
+		JID:     jid.String(),
+		Created: time.Now().Unix(),
+		Tables:  make(map[string][]map[string]backupCell),
+	}
+	for _, table := range deviceTables {
+		rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s=$1", table.name, table.owner), jid.String())
+		if err != nil {
+			return nil, err
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			for i := range values {
+				values[i] = new(interface{})
+			}
+			if err = rows.Scan(values...); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			row := make(map[string]backupCell, len(columns))
+			for i, column := range columns {
+				var cell backupCell
+				switch value := (*values[i].(*interface{})).(type) {
+				case []byte:
+					cell.Bytes = append([]byte{}, value...)
+				case int64:
+					cell.Int = &value
+				case string:
+					cell.Text = &value
+				case bool:
+					cell.Bool = &value
+				case nil:
+				default:
+					_ = rows.Close()
+					return nil, fmt.Errorf("unexpected %T in %s.%s", value, table.name, column)
+				}
+				row[column] = cell
+			}
+			backup.Tables[table.name] = append(backup.Tables[table.name], row)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return backup, nil
+}
+
+// importDevice replaces the stored state of the device of backup.
+func importDevice(backup *deviceBackup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err = tx.Exec("DELETE FROM whatsmeow_device WHERE jid=$1", backup.JID); err != nil {
+		return err
+	}
+	// the privacy tokens are the one table not cascading from the device
+	if _, err = tx.Exec("DELETE FROM whatsmeow_privacy_tokens WHERE our_jid=$1", backup.JID); err != nil {
+		return err
+	}
+	for _, table := range deviceTables {
+		for _, row := range backup.Tables[table.name] {
+			if row[table.owner].Text == nil || *row[table.owner].Text != backup.JID {
+				return fmt.Errorf("row of %s does not belong to %s", table.name, backup.JID)
+			}
+			columns := make([]string, 0, len(row))
+			placeholders := make([]string, 0, len(row))
+			values := make([]interface{}, 0, len(row))
+			for column, cell := range row {
+				if !validColumn(column) {
+					return fmt.Errorf("invalid column %q in %s", column, table.name)
+				}
+				columns = append(columns, column)
+				values = append(values, cell.value())
+				placeholders = append(placeholders, fmt.Sprintf("$%d", len(values)))
+			}
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.name, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+			if _, err = tx.Exec(query, values...); err != nil {
+				return fmt.Errorf("restoring %s: %w", table.name, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// validColumn keeps column names from backups out of the SQL unless they
+// look like the identifiers whatsmeow uses.
+func validColumn(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// backupKey derives the encryption key of a backup from the passphrase.
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// sealBackup compresses and encrypts a backup with AES-GCM, the result is
+// the salt and nonce followed by the ciphertext.
+func sealBackup(backup *deviceBackup, passphrase string) ([]byte, error) {
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	if err := json.NewEncoder(zw).Encode(backup); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(append(salt, nonce...), nonce, plain.Bytes(), nil), nil
+}
+
+var errBadBackup = errors.New("backup is damaged or the passphrase is wrong")
+
+func openBackup(data []byte, passphrase string) (*deviceBackup, error) {
+	if len(data) < 16 {
+		return nil, errBadBackup
+	}
+	gcm, err := backupCipher(passphrase, data[:16])
+	if err != nil {
+		return nil, err
+	}
+	data = data[16:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errBadBackup
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errBadBackup
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, errBadBackup
+	}
+	backup := &deviceBackup{}
+	if err = json.NewDecoder(zr).Decode(backup); err != nil {
+		return nil, errBadBackup
+	}
+	if backup.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", backup.Version)
+	}
+	return backup, nil
+}
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupPassphrase is the passphrase given with the request, or the server
+// key when there is none.
+func backupPassphrase(r *http.Request) string {
+	if passphrase := r.URL.Query().Get("passphrase"); passphrase != "" {
+		return passphrase
+	}
+	if passphrase := r.Header.Get("X-Passphrase"); passphrase != "" {
+		return passphrase
+	}
+	return currentSettings().serverKey
+}
+
+// handleSessionExport downloads the encrypted device state of the session,
+// which /session/import restores without pairing again.
+func handleSessionExport(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the backup holds the keys of the account, only the server key may
+		// move it
+		if authorize(sess, r, r.URL.Query().Get("key")) != fullAccess {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		cli := sess.Client()
+		if cli == nil || cli.Store.ID == nil {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("session is not paired"))
+			return
+		}
+		passphrase := backupPassphrase(r)
+		if passphrase == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("passphrase is required without a server key"))
+			return
+		}
+		backup, err := exportDevice(*cli.Store.ID)
+		if err == nil && len(backup.Tables["whatsmeow_device"]) == 0 {
+			err = errors.New("device is not in the store")
+		}
+		var sealed []byte
+		if err == nil {
+			sealed, err = sealBackup(backup, passphrase)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.wabackup"`, sess.name))
+		_, _ = w.Write(sealed)
+	}
+}
+
+// handleSessionImport restores a backup made by /session/export as the
+// device of the session, which must not be logged in, and connects with it.
+func handleSessionImport(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the backup holds the keys of the account, only the server key may
+		// move it
+		if authorize(sess, r, r.URL.Query().Get("key")) != fullAccess {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if sess.isReady() {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("session is logged in, log out first"))
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		backup, err := openBackup(data, backupPassphrase(r))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		jid, err := types.ParseJID(backup.JID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		for _, other := range allSessions() {
+			if cli := other.Client(); other != sess && cli != nil && cli.Store.ID != nil && *cli.Store.ID == jid {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte("device belongs to session " + other.name))
+				return
+			}
+		}
+		if err = importDevice(backup); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		device, err := container.GetDevice(jid)
+		if err == nil && !validDevice(device) {
+			err = errors.New("restored device is not usable")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		sess.lock.Lock()
+		sess.device = device
+		sess.missingDevice = ""
+		sess.lock.Unlock()
+		// the pending login of the old device is of no use anymore
+		if cli := sess.Client(); cli != nil {
+			cli.Disconnect()
+		}
+		if err = sess.connect(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("restored but failed to connect: %s", err)))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"jid": jid.String(),
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+const (
+	batchPending = "pending"
+	batchSent    = "sent"
+	batchFailed  = "failed"
+)
+
+func upgradeBatches() error {
+	idType, refType := dbColumns.id, dbColumns.ref
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS batch_jobs (
+		id         ` + idType + ` PRIMARY KEY,
+		session    TEXT    NOT NULL,
+		owner      TEXT,
+		created_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	// tables from before jobs had an owner, probing works on every dialect
+	if _, err = db.Exec(`SELECT owner FROM batch_jobs WHERE 1=0`); err != nil {
+		if _, err = db.Exec(`ALTER TABLE batch_jobs ADD COLUMN owner TEXT`); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS batch_items (
+		id         ` + idType + ` PRIMARY KEY,
+		job_id     ` + refType + ` NOT NULL REFERENCES batch_jobs(id) ON DELETE CASCADE,
+		recipient  TEXT    NOT NULL,
+		text       TEXT    NOT NULL,
+		status     TEXT    NOT NULL,
+		message_id TEXT,
+		last_error TEXT
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS batch_items_job ON batch_items (job_id, status)`)
+	return err
+}
+
+// batchRow is a message of a batch upload.
+type batchRow struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// readBatch reads the rows of a batch upload, either a CSV of number,text
+// rows with an optional header line or a JSON array of {to, text} objects.
+// CSV may also come as the multipart file part named file.
+func readBatch(r *http.Request) ([]batchRow, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var body io.Reader = r.Body
+	switch contentType {
+	case "application/json":
+		var rows []batchRow
+		if err := json.NewDecoder(r.Body).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("invalid json body: %w", err)
+		}
+		return rows, nil
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("file is required: %w", err)
+		}
+		defer file.Close()
+		body = file
+	}
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	var rows []batchRow
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		if line == 1 && (strings.EqualFold(record[0], "number") || strings.EqualFold(record[0], "to")) {
+			continue
+		}
+		rows = append(rows, batchRow{To: record[0], Text: record[1]})
+	}
+}
+
+// handleSendBatch stores an uploaded batch as a job which the session sends
+// in the background within the rate limits, and answers 202 with its id.
+// Recipients are resolved as /send does and checked against the key up
+// front, so a job never stops half way for permissions. The key comes with
+// the query or as Basic auth, it is checked before the upload is read.
+func handleSendBatch(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		acl := authorize(sess, r, r.URL.Query().Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		rows, err := readBatch(r)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		if len(rows) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("batch has no rows"))
+			return
+		}
+		for i, row := range rows {
+			if row.Text == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(fmt.Sprintf("row %d: text is required", i+1)))
+				return
+			}
+			// the rate limits apply when the items are sent
+			jid, sendErr := sess.checkRecipient(acl, row.To, true)
+			if sendErr != nil {
+				w.WriteHeader(sendErr.status)
+				_, _ = w.Write([]byte(fmt.Sprintf("row %d: %s", i+1, sendErr.err)))
+				return
+			}
+			// group names are resolved once, renaming a group does not
+			// redirect the job
+			rows[i].To = jid.String()
+		}
+		id, err := sess.storeBatch(rows, batchOwner(acl))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		select {
+		case sess.batchWake <- struct{}{}:
+		default:
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"jobId": id,
+			"total": len(rows),
+		})
+	}
+}
+
+// batchOwner identifies the key a job is submitted with, only a hash of it
+// is stored. Jobs of the server key have no owner.
+func batchOwner(acl *keyACL) sql.NullString {
+	if acl == fullAccess {
+		return sql.NullString{}
+	}
+	sum := sha256.Sum256([]byte(acl.Key))
+	return sql.NullString{String: hex.EncodeToString(sum[:]), Valid: true}
+}
+
+func (s *session) storeBatch(rows []batchRow, owner sql.NullString) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var id int64
+	err = tx.QueryRow(`INSERT INTO batch_jobs (session, owner, created_at) VALUES ($1, $2, $3) RETURNING id`, s.name, owner, time.Now().Unix()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		_, err = tx.Exec(
+			`INSERT INTO batch_items (job_id, recipient, text, status) VALUES ($1, $2, $3, $4)`,
+			id, row.To, row.Text, batchPending,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// runBatches works through the pending batch items of the session one at a
+// time, oldest job first, waiting whenever the rate limits or the
+// connection say so. Items are in the database, so jobs carry on after a
+// restart.
+func (s *session) runBatches() {
+	for {
+		wait := s.sendNextBatchItem()
+		if wait == 0 {
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.batchWake:
+		}
+	}
+}
+
+// sendNextBatchItem sends the next pending item and returns how long to wait
+// before the next one, 0 to go on right away.
+func (s *session) sendNextBatchItem() time.Duration {
+	if !s.isReady() {
+		return 5 * time.Second
+	}
+	var id int64
+	var recipient, text string
+	err := db.QueryRow(
+		`SELECT i.id, i.recipient, i.text FROM batch_items i JOIN batch_jobs j ON j.id=i.job_id
+		WHERE j.session=$1 AND i.status=$2 ORDER BY i.id LIMIT 1`,
+		s.name, batchPending,
+	).Scan(&id, &recipient, &text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Minute
+	} else if err != nil {
+		mainLog.Errorf("Error reading batch items: %s", err)
+		return time.Minute
+	}
+	jid, err := s.resolveRecipient(recipient)
+	if err == nil {
+		if ok, retryAfter := s.allowSend(jid); !ok {
+			return retryAfter
+		}
+		var resp whatsmeow.SendResponse
+		resp, _, err = s.send(context.Background(), jid, &proto.Message{Conversation: gproto.String(text)})
+		if errors.Is(err, whatsmeow.ErrNotConnected) {
+			return 5 * time.Second
+		}
+		if err == nil {
+			_, err = db.Exec(`UPDATE batch_items SET status=$1, message_id=$2 WHERE id=$3`, batchSent, resp.ID, id)
+			if err != nil {
+				mainLog.Errorf("Error updating batch items: %s", err)
+				return time.Minute
+			}
+			return 0
+		}
+	}
+	s.log.Warnf("Error sending batch item %d: %s", id, err)
+	if _, err = db.Exec(`UPDATE batch_items SET status=$1, last_error=$2 WHERE id=$3`, batchFailed, err.Error(), id); err != nil {
+		mainLog.Errorf("Error updating batch items: %s", err)
+		return time.Minute
+	}
+	return 0
+}
+
+// handleBatchJob reports the progress of a batch job, to the key which
+// submitted it or the server key.
+func handleBatchJob(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		acl := authorize(sess, r, r.URL.Query().Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/send/batch/"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var created int64
+		var owner sql.NullString
+		err = db.QueryRow(`SELECT owner, created_at FROM batch_jobs WHERE id=$1 AND session=$2`, id, sess.name).Scan(&owner, &created)
+		// jobs of other keys are as unknown as missing ones
+		if err == nil && acl != fullAccess && owner != batchOwner(acl) {
+			err = sql.ErrNoRows
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown job id"))
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		rows, err := db.Query(`SELECT status, COUNT(*) FROM batch_items WHERE job_id=$1 GROUP BY status`, id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		defer rows.Close()
+		counts := map[string]int{batchPending: 0, batchSent: 0, batchFailed: 0}
+		total := 0
+		for rows.Next() {
+			var status string
+			var n int
+			if err = rows.Scan(&status, &n); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			counts[status] = n
+			total += n
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"jobId":     id,
+			"createdAt": created,
+			"total":     total,
+			"pending":   counts[batchPending],
+			"sent":      counts[batchSent],
+			"failed":    counts[batchFailed],
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// blockedJIDs lists the JIDs of a blocklist in a stable order.
+func blockedJIDs(list *types.Blocklist) []string {
+	jids := make([]string, 0, len(list.JIDs))
+	for _, jid := range list.JIDs {
+		jids = append(jids, jid.String())
+	}
+	sort.Strings(jids)
+	return jids
+}
+
+// handleBlocklist lists the users blocked by the account.
+func handleBlocklist(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(sess, r, r.URL.Query().Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		list, err := sess.Client().GetBlocklist()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, blockedJIDs(list))
+	}
+}
+
+// handleBlock blocks the user given as jid, or with the unblock path
+// unblocks them, and answers with the updated blocklist.
+func handleBlock(sess *session, block bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		_ = r.ParseForm()
+		acl := authorize(sess, r, r.Form.Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("jid") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("jid is required"))
+			return
+		}
+		jid, err := normalizeJID(r.Form.Get("jid"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if jid.Server != types.DefaultUserServer {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("only users can be blocked"))
+			return
+		}
+		if !acl.allowsDestination(jid) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		action := events.BlocklistChangeActionBlock
+		if !block {
+			action = events.BlocklistChangeActionUnblock
+		}
+		list, err := sess.Client().UpdateBlocklist(jid, action)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, blockedJIDs(list))
+	}
+}
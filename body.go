@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// limitBody rejects request bodies larger than limit bytes, up front when
+// the length is announced and once reading goes past it otherwise. Handlers
+// report the latter through bodyError.
+func limitBody(limit int64, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = w.Write([]byte(fmt.Sprintf("request body exceeds %d bytes", limit)))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyError answers a request whose body could not be read, with 413 when
+// it went past -max-body.
+func bodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte(fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)))
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write([]byte(err.Error()))
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// brokerRetryDelay is how long the consumer waits before connecting to
+	// -queue-url again after losing the connection, and before taking on
+	// requests again after putting one back.
+	brokerRetryDelay = 5 * time.Second
+	// brokerAckWait is how long NATS waits for a request to be settled
+	// before handing it out again, waits for the rate limits extend it.
+	brokerAckWait = 2 * time.Minute
+	// brokerPoll bounds the blocking reads so dead connections show up.
+	brokerPoll = 30 * time.Second
+)
+
+// broker is the connection to -queue-url the send requests are taken from.
+type broker interface {
+	// next blocks until a request arrives or ctx is done.
+	next(ctx context.Context) (*brokerDelivery, error)
+	// publish delivers a result to a list or subject.
+	publish(ctx context.Context, to string, data []byte) error
+	Close() error
+}
+
+// brokerDelivery is a request taken from the queue. It stays with the
+// queue until ack removes it for good, nak hands it out again, and if the
+// service stops before either the queue hands it out again by itself.
+type brokerDelivery struct {
+	data []byte
+	ack  func() error
+	nak  func() error
+	// progress tells the queue the request is still being worked on.
+	progress func()
+}
+
+// brokerRequest is a send request taken from -queue-url, the fields of
+// /send for a text message along with ID, which the result echoes.
+type brokerRequest struct {
+	ID      string `json:"id"`
+	Session string `json:"session"`
+	// ReplyTo overrides the list or subject the result is published to.
+	ReplyTo string `json:"replyTo"`
+	sendRequest
+}
+
+type brokerResult struct {
+	ID        string `json:"id,omitempty"`
+	Session   string `json:"session,omitempty"`
+	To        string `json:"to,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+	QueueID   int64  `json:"queueId,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// checkQueueURL rejects a -queue-url the consumer can not connect to.
+func checkQueueURL(queueURL string) error {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return fmt.Errorf("invalid -queue-url: %w", err)
+	}
+	switch u.Scheme {
+	case "redis", "rediss", "nats", "tls":
+		return nil
+	default:
+		return fmt.Errorf("invalid -queue-url scheme %q, expected redis, rediss, nats or tls", u.Scheme)
+	}
+}
+
+// dialBroker connects to a Redis list, rediss:// over TLS, or to a NATS
+// JetStream subject, tls:// over TLS. The list is named by the key query
+// parameter and the subject by subject, reply names where results go when
+// requests do not say.
+func dialBroker(ctx context.Context, queueURL string) (broker, string, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, "", err
+	}
+	reply := u.Query().Get("reply")
+	switch u.Scheme {
+	case "redis", "rediss":
+		b, err := dialRedis(ctx, u)
+		return b, reply, err
+	default:
+		b, err := dialNATS(u)
+		return b, reply, err
+	}
+}
+
+// runBroker consumes -queue-url until shutdown, the requests are sent one at
+// a time so bursts wait in the queue rather than running into the rate
+// limits.
+func runBroker(ctx context.Context) {
+	for ctx.Err() == nil {
+		b, reply, err := dialBroker(ctx, queueURL)
+		if err != nil {
+			mainLog.Errorf("Error connecting to the message queue: %s", err)
+		} else {
+			mainLog.Infof("Consuming send requests from the message queue")
+			consumeBroker(ctx, b, reply)
+			_ = b.Close()
+		}
+		select {
+		case <-time.After(brokerRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func consumeBroker(ctx context.Context, b broker, reply string) {
+	for {
+		d, err := b.next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				mainLog.Errorf("Error reading from the message queue: %s", err)
+			}
+			return
+		}
+		// shutdown waits for the request like for the ones over HTTP
+		inFlight.Add(1)
+		retry, err := settleBrokerRequest(ctx, b, d, reply)
+		inFlight.Done()
+		if err != nil {
+			mainLog.Errorf("Error settling a message queue request: %s", err)
+			return
+		}
+		if retry {
+			select {
+			case <-time.After(brokerRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// settleBrokerRequest handles a request and then removes it from the queue
+// once its result is published. Requests which failed for a reason that
+// passes, such as the session being disconnected or the service shutting
+// down, are put back for another try instead and retry is true.
+func settleBrokerRequest(ctx context.Context, b broker, d *brokerDelivery, reply string) (bool, error) {
+	result, replyTo, retry := handleBrokerRequest(ctx, d)
+	if retry {
+		return true, d.nak()
+	}
+	if replyTo == "" {
+		replyTo = reply
+	}
+	if replyTo != "" {
+		encoded, _ := json.Marshal(result)
+		// if this fails the request stays with the queue and is sent again
+		if err := b.publish(context.WithoutCancel(ctx), replyTo, encoded); err != nil {
+			return false, err
+		}
+	}
+	return false, d.ack()
+}
+
+// handleBrokerRequest sends the text message of a request from the queue.
+// The queue is trusted like the server key, the rate limits are waited out
+// instead of failing the request. A send which started is let finish when
+// the service shuts down, as the ones over HTTP are.
+func handleBrokerRequest(ctx context.Context, d *brokerDelivery) (*brokerResult, string, bool) {
+	var req brokerRequest
+	if err := json.Unmarshal(d.data, &req); err != nil {
+		return &brokerResult{Error: "invalid request: " + err.Error(), Code: "invalid_request"}, "", false
+	}
+	result := &brokerResult{ID: req.ID, Session: req.Session}
+	fail := func(code string, err error) (*brokerResult, string, bool) {
+		result.Error, result.Code = err.Error(), code
+		return result, req.ReplyTo, false
+	}
+	sess := lookupSession(req.Session)
+	if sess == nil {
+		return fail("unknown_session", fmt.Errorf("unknown session %q", req.Session))
+	}
+	result.Session = sess.name
+	if len(req.To) != 1 {
+		return fail("invalid_request", errors.New("exactly one recipient is required"))
+	}
+	result.To = req.To[0]
+	if req.Text == "" {
+		return fail("invalid_request", errors.New("text is required"))
+	}
+	for {
+		jid, sendErr := sess.checkRecipient(fullAccess, req.To[0], false)
+		if sendErr != nil && sendErr.status == http.StatusTooManyRequests {
+			d.progress()
+			select {
+			case <-time.After(sendErr.retryAfter):
+				continue
+			case <-ctx.Done():
+				return nil, "", true
+			}
+		}
+		if sendErr != nil {
+			return fail("invalid_recipient", sendErr)
+		}
+		msg, err := textMessage(jid, &req.sendRequest, nil)
+		if err != nil {
+			return fail("invalid_request", err)
+		}
+		delivery, err := sess.dispatch(context.WithoutCancel(ctx), jid, msg)
+		if err != nil {
+			status, code := classifySendError(err)
+			if status == http.StatusServiceUnavailable {
+				// not connected or not logged in yet
+				return nil, "", true
+			}
+			return fail(code, err)
+		}
+		if delivery.queueID != 0 {
+			result.QueueID = delivery.queueID
+		} else {
+			result.MessageID = delivery.resp.ID
+			result.Timestamp = delivery.resp.Timestamp.Unix()
+		}
+		return result, req.ReplyTo, false
+	}
+}
+
+// redisBroker takes requests from a Redis list by moving them to a
+// processing list, where they stay until settled. Whatever is left in the
+// processing list, by a run which stopped midway, goes back to the queue on
+// connecting, so instances sharing a list need a processing list each.
+type redisBroker struct {
+	client     *redis.Client
+	key        string
+	processing string
+}
+
+func dialRedis(ctx context.Context, u *url.URL) (*redisBroker, error) {
+	query := u.Query()
+	b := &redisBroker{key: query.Get("key"), processing: query.Get("processing")}
+	if b.key == "" {
+		b.key = "waservice:send"
+	}
+	if b.processing == "" {
+		b.processing = b.key + ":processing"
+	}
+	// go-redis refuses query parameters it does not know
+	for _, name := range []string{"key", "processing", "reply"} {
+		query.Del(name)
+	}
+	plain := *u
+	plain.RawQuery = query.Encode()
+	options, err := redis.ParseURL(plain.String())
+	if err != nil {
+		return nil, err
+	}
+	// commands honour the deadlines of their contexts, the blocking reads
+	// notice shutdown at the latest after brokerPoll
+	options.ContextTimeoutEnabled = true
+	b.client = redis.NewClient(options)
+	for {
+		err = b.client.LMove(ctx, b.processing, b.key, "RIGHT", "LEFT").Err()
+		if errors.Is(err, redis.Nil) {
+			return b, nil
+		}
+		if err != nil {
+			_ = b.client.Close()
+			return nil, err
+		}
+	}
+}
+
+func (b *redisBroker) next(ctx context.Context) (*brokerDelivery, error) {
+	for {
+		data, err := b.client.BLMove(ctx, b.key, b.processing, "LEFT", "RIGHT", brokerPoll).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &brokerDelivery{
+			data: []byte(data),
+			ack: func() error {
+				return b.client.LRem(context.Background(), b.processing, 1, data).Err()
+			},
+			nak: func() error {
+				_, err := b.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+					pipe.RPush(context.Background(), b.key, data)
+					pipe.LRem(context.Background(), b.processing, 1, data)
+					return nil
+				})
+				return err
+			},
+			progress: func() {},
+		}, nil
+	}
+}
+
+func (b *redisBroker) publish(ctx context.Context, to string, data []byte) error {
+	return b.client.RPush(ctx, to, data).Err()
+}
+
+func (b *redisBroker) Close() error {
+	return b.client.Close()
+}
+
+// natsBroker pulls requests from a JetStream stream through a durable
+// consumer, named by the consumer query parameter, which instances share.
+// The stream capturing the subject has to exist, requests are acknowledged
+// once settled and redelivered otherwise.
+type natsBroker struct {
+	conn *nats.Conn
+	sub  *nats.Subscription
+}
+
+func dialNATS(u *url.URL) (*natsBroker, error) {
+	query := u.Query()
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "waservice.send"
+	}
+	consumer := query.Get("consumer")
+	if consumer == "" {
+		consumer = "waservice"
+	}
+	plain := *u
+	plain.RawQuery = ""
+	conn, err := nats.Connect(plain.String(), nats.Name("waservice"), nats.NoReconnect())
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(subject, consumer, nats.ManualAck(), nats.AckWait(brokerAckWait))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error subscribing to %s, it needs a JetStream stream: %w", subject, err)
+	}
+	return &natsBroker{conn: conn, sub: sub}, nil
+}
+
+func (b *natsBroker) next(ctx context.Context) (*brokerDelivery, error) {
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, brokerPoll)
+		msgs, err := b.sub.Fetch(1, nats.Context(fetchCtx))
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg := msgs[0]
+		return &brokerDelivery{
+			data: msg.Data,
+			ack: func() error {
+				return msg.Ack()
+			},
+			nak: func() error {
+				return msg.NakWithDelay(brokerRetryDelay)
+			},
+			progress: func() {
+				_ = msg.InProgress()
+			},
+		}, nil
+	}
+}
+
+func (b *natsBroker) publish(ctx context.Context, to string, data []byte) error {
+	if err := b.conn.Publish(to, data); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return b.conn.FlushWithContext(ctx)
+}
+
+func (b *natsBroker) Close() error {
+	b.conn.Close()
+	return nil
+}
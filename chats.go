@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow/appstate"
+)
+
+// handleChat organizes a chat in the chat list of the account, action is one
+// of archive, unarchive, pin, unpin, mute or unmute. Mutes last for the
+// duration given as for, or until unmuted without it. Archiving also unpins
+// the chat.
+func handleChat(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		_ = r.ParseForm()
+		acl := authorize(sess, r, r.Form.Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("chat") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("chat is required"))
+			return
+		}
+		chat, err := normalizeJID(r.Form.Get("chat"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if !acl.allowsDestination(chat) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		var patch appstate.PatchInfo
+		switch action := r.Form.Get("action"); action {
+		case "archive", "unarchive":
+			patch = appstate.BuildArchive(chat, action == "archive", time.Time{}, nil)
+		case "pin", "unpin":
+			patch = appstate.BuildPin(chat, action == "pin")
+		case "mute", "unmute":
+			var duration time.Duration
+			if value := r.Form.Get("for"); value != "" && action == "mute" {
+				duration, err = time.ParseDuration(value)
+				if err != nil || duration <= 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte("invalid for duration"))
+					return
+				}
+			}
+			patch = appstate.BuildMute(chat, action == "mute", duration)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("action must be one of archive, unarchive, pin, unpin, mute or unmute"))
+			return
+		}
+		if err = sess.Client().SendAppState(patch); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envName is the environment variable a flag can be set with, -http becomes
+// WA_HTTP and -status-ttl becomes WA_STATUS_TTL.
+func envName(flagName string) string {
+	return "WA_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyConfig fills in the flags which were not given on the command line,
+// from the environment first and then from the -config file, whose keys are
+// the flag names.
+func applyConfig(file string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	config, err := readConfigFile(file)
+	if err != nil {
+		return err
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		source := envName(f.Name)
+		if !ok {
+			var v interface{}
+			if v, ok = config[f.Name]; ok {
+				value, source = fmt.Sprint(v), file
+			}
+		}
+		if !ok {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for -%s from %s: %w", value, f.Name, source, setErr)
+		}
+	})
+	return err
+}
+
+// readConfigFile reads the -config file into its options by flag name, no
+// file gives no options.
+func readConfigFile(file string) (map[string]interface{}, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]interface{}
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	default:
+		// numbers stay as written, a float64 would print 33554432 as
+		// 3.3554432e+07
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+	for name := range config {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("invalid config file %s: unknown option %q", file, name)
+		}
+	}
+	return config, nil
+}
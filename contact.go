@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// contactCard is a contact sent by /send/contact, either a name and phone
+// number or a complete vCard.
+type contactCard struct {
+	Name  string `json:"name"`
+	Phone string `json:"phone"`
+	Vcard string `json:"vcard"`
+}
+
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`)
+
+// contactMessage builds the message of a single contact. The waid parameter
+// lets WhatsApp offer to chat with the number right away.
+func contactMessage(card contactCard) (*proto.ContactMessage, error) {
+	vcard := card.Vcard
+	if vcard == "" {
+		number := phoneDigits(card.Phone)
+		if card.Name == "" || number == "" {
+			return nil, errors.New("each contact needs a name and a phone number, or a vcard")
+		}
+		vcard = fmt.Sprintf("BEGIN:VCARD\nVERSION:3.0\nFN:%s\nTEL;type=CELL;type=VOICE;waid=%s:+%s\nEND:VCARD", vcardEscaper.Replace(card.Name), number, number)
+	} else if !strings.HasPrefix(strings.TrimSpace(vcard), "BEGIN:VCARD") {
+		return nil, errors.New("vcard must start with BEGIN:VCARD")
+	}
+	name := card.Name
+	if name == "" {
+		name = vcardName(vcard)
+	}
+	return &proto.ContactMessage{
+		DisplayName: gproto.String(name),
+		Vcard:       gproto.String(vcard),
+	}, nil
+}
+
+// vcardName returns the formatted name of a vCard.
+func vcardName(vcard string) string {
+	for _, line := range strings.Split(vcard, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "FN:"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func handleSendContact(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		cards := req.Contacts
+		if len(cards) == 0 {
+			cards = []contactCard{{Name: req.Name, Phone: req.Phone, Vcard: req.Vcard}}
+		}
+		contacts := make([]*proto.ContactMessage, 0, len(cards))
+		for _, card := range cards {
+			contact, err := contactMessage(card)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			contacts = append(contacts, contact)
+		}
+		msg := &proto.Message{ContactMessage: contacts[0]}
+		if len(contacts) > 1 {
+			msg = &proto.Message{ContactsArrayMessage: &proto.ContactsArrayMessage{
+				DisplayName: gproto.String(fmt.Sprintf("%d contacts", len(contacts))),
+				Contacts:    contacts,
+			}}
+		}
+		deliver(w, r, sess, jid, msg)
+	}
+}
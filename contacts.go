@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// handleContacts lists the contacts known to the device store, optionally
+// filtered by a case-insensitive search on their names.
+func handleContacts(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		contacts, err := sess.Client().Store.Contacts.GetAllContacts()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		search := strings.ToLower(r.Form.Get("search"))
+		result := make([]map[string]interface{}, 0, len(contacts))
+		for jid, contact := range contacts {
+			if search != "" &&
+				!strings.Contains(strings.ToLower(contact.PushName), search) &&
+				!strings.Contains(strings.ToLower(contact.BusinessName), search) &&
+				!strings.Contains(strings.ToLower(contact.FullName), search) {
+				continue
+			}
+			result = append(result, map[string]interface{}{
+				"jid":          jid.String(),
+				"pushName":     contact.PushName,
+				"businessName": contact.BusinessName,
+				"fullName":     contact.FullName,
+			})
+		}
+		// map order is random, keep the output stable between calls
+		sort.Slice(result, func(i, j int) bool {
+			return result[i]["jid"].(string) < result[j]["jid"].(string)
+		})
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// cors answers preflight requests and allows the origins listed in
+// -cors-origins to call the API from a browser, "*" allows every origin.
+func cors(origins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowed["*"] && !allowed[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		if allowed["*"] {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Add("Vary", "Origin")
+		}
+		header.Set("Access-Control-Expose-Headers", "X-Request-ID, X-Attempts, Retry-After, Idempotent-Replayed")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, X-Request-ID")
+			header.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
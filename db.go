@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// dbDriver is a database -db-dialect can pick. The files registering them
+// are left out with build tags, so builds only carry the drivers they need:
+// nosqlite drops the pure Go SQLite, nopostgres drops Postgres and sqlite3
+// adds github.com/mattn/go-sqlite3, which needs CGO.
+type dbDriver struct {
+	// driver is the database/sql driver name, dialect the one whatsmeow's
+	// sqlstore is told about.
+	driver  string
+	dialect string
+	// dsn turns -db into the data source name of the driver.
+	dsn func(path string) string
+	// columns are the types the tables of the service are created with.
+	columns columnTypes
+}
+
+// columnTypes name the column types which differ between the databases: id
+// is an auto incrementing primary key, ref refers to one and blob holds
+// bytes.
+type columnTypes struct {
+	id, ref, blob string
+}
+
+var (
+	// sqlite assigns INTEGER PRIMARY KEY columns by itself, Postgres needs
+	// a serial and has no BLOB
+	sqliteColumns   = columnTypes{id: "INTEGER", ref: "INTEGER", blob: "BLOB"}
+	postgresColumns = columnTypes{id: "BIGSERIAL", ref: "BIGINT", blob: "BYTEA"}
+)
+
+// dbColumns are the column types of the database in use.
+var dbColumns columnTypes
+
+var dbDrivers = map[string]*dbDriver{}
+
+// registerDBDriver makes a driver available as -db-dialect name, it is
+// called from init.
+func registerDBDriver(name string, driver *dbDriver) {
+	dbDrivers[name] = driver
+}
+
+// dbDialects lists the names -db-dialect accepts.
+func dbDialects() string {
+	names := make([]string, 0, len(dbDrivers))
+	for name := range dbDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// openDB opens the database at path with driver.
+func openDB(driver *dbDriver, path string) (*sql.DB, error) {
+	return sql.Open(driver.driver, driver.dsn(path))
+}
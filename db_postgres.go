@@ -0,0 +1,19 @@
+//go:build !nopostgres
+
+package main
+
+import (
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	registerDBDriver("postgres", &dbDriver{
+		driver:  "postgres",
+		dialect: "postgres",
+		// -db is the connection string, Postgres enforces foreign keys anyway
+		dsn: func(path string) string {
+			return path
+		},
+		columns: postgresColumns,
+	})
+}
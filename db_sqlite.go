@@ -0,0 +1,24 @@
+//go:build !nosqlite
+
+package main
+
+import (
+	"fmt"
+
+	_ "github.com/glebarez/sqlite"
+)
+
+func init() {
+	registerDBDriver("sqlite", &dbDriver{
+		driver:  "sqlite",
+		dialect: "sqlite",
+		// WAL lets readers carry on while the sends and the queue write,
+		// the busy timeout makes writers wait for each other instead of
+		// failing with "database is locked"
+		dsn: func(path string) string {
+			return fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=journal_mode(%s)&_pragma=busy_timeout(%d)",
+				path, dbJournalMode, dbBusyTimeout.Milliseconds())
+		},
+		columns: sqliteColumns,
+	})
+}
@@ -0,0 +1,22 @@
+//go:build sqlite3
+
+package main
+
+import (
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlite3 is SQLite through CGO, built with -tags sqlite3.
+func init() {
+	registerDBDriver("sqlite3", &dbDriver{
+		driver:  "sqlite3",
+		dialect: "sqlite3",
+		dsn: func(path string) string {
+			return fmt.Sprintf("file:%s?_foreign_keys=1&_journal_mode=%s&_busy_timeout=%d",
+				path, dbJournalMode, dbBusyTimeout.Milliseconds())
+		},
+		columns: sqliteColumns,
+	})
+}
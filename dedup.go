@@ -0,0 +1,40 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// seenMessages remembers the last -dedup-size incoming messages, whatsmeow
+// may deliver a message again after a reconnect and receivers should not
+// get it twice.
+var seenMessages = struct {
+	lock  sync.Mutex
+	order *list.List
+	byKey map[string]*list.Element
+}{order: list.New(), byKey: map[string]*list.Element{}}
+
+// firstDelivery records the message of evt and tells whether it is new, it
+// is always true with -dedup-size 0.
+func (s *session) firstDelivery(evt *events.Message) bool {
+	if dedupSize <= 0 {
+		return true
+	}
+	// message ids are only unique per sender
+	key := s.name + "/" + evt.Info.Chat.String() + "/" + evt.Info.Sender.ToNonAD().String() + "/" + evt.Info.ID
+	seenMessages.lock.Lock()
+	defer seenMessages.lock.Unlock()
+	if element, ok := seenMessages.byKey[key]; ok {
+		seenMessages.order.MoveToFront(element)
+		return false
+	}
+	seenMessages.byKey[key] = seenMessages.order.PushFront(key)
+	for seenMessages.order.Len() > dedupSize {
+		oldest := seenMessages.order.Back()
+		seenMessages.order.Remove(oldest)
+		delete(seenMessages.byKey, oldest.Value.(string))
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+)
+
+// applyDeviceProps sets the name, version and platform the phone lists the
+// linked device with, from -device-name, -device-version and
+// -device-platform. They are sent while pairing, so changing them later
+// needs pairing again.
+func applyDeviceProps() error {
+	if deviceName == "" && deviceVersion == "" && devicePlatform == "" {
+		return nil
+	}
+	if devicePlatform != "" {
+		platform, ok := proto.DeviceProps_PlatformType_value[strings.ToUpper(devicePlatform)]
+		if !ok {
+			return fmt.Errorf("invalid -device-platform %q, expected e.g. chrome, firefox, safari, edge or desktop", devicePlatform)
+		}
+		store.DeviceProps.PlatformType = proto.DeviceProps_PlatformType(platform).Enum()
+	}
+	name := store.DeviceProps.GetOs()
+	if deviceName != "" {
+		name = deviceName
+	}
+	version := [3]uint32{
+		store.DeviceProps.GetVersion().GetPrimary(),
+		store.DeviceProps.GetVersion().GetSecondary(),
+		store.DeviceProps.GetVersion().GetTertiary(),
+	}
+	if deviceVersion != "" {
+		parts := strings.Split(deviceVersion, ".")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid -device-version %q, expected up to three numbers such as 1.2.3", deviceVersion)
+		}
+		version = [3]uint32{}
+		for i, part := range parts {
+			n, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid -device-version %q, expected up to three numbers such as 1.2.3", deviceVersion)
+			}
+			version[i] = uint32(n)
+		}
+	}
+	store.SetOSInfo(name, version)
+	return nil
+}
+
+// pairClients maps the platforms of -device-platform to the client type
+// announced when pairing with a phone-number code.
+var pairClients = map[proto.DeviceProps_PlatformType]struct {
+	clientType whatsmeow.PairClientType
+	browser    string
+}{
+	proto.DeviceProps_CHROME:  {whatsmeow.PairClientChrome, "Chrome"},
+	proto.DeviceProps_FIREFOX: {whatsmeow.PairClientFirefox, "Firefox"},
+	proto.DeviceProps_IE:      {whatsmeow.PairClientIE, "IE"},
+	proto.DeviceProps_OPERA:   {whatsmeow.PairClientOpera, "Opera"},
+	proto.DeviceProps_SAFARI:  {whatsmeow.PairClientSafari, "Safari"},
+	proto.DeviceProps_EDGE:    {whatsmeow.PairClientEdge, "Edge"},
+	proto.DeviceProps_DESKTOP: {whatsmeow.PairClientElectron, "Desktop"},
+	proto.DeviceProps_UWP:     {whatsmeow.PairClientUWP, "UWP"},
+}
+
+// pairClient is the client type and display name phone-number code pairing
+// announces, the same as QR pairing does from store.DeviceProps. The display
+// name has to be formatted as "Browser (OS)", platforms without a client
+// type of their own are shown as Chrome.
+func pairClient() (whatsmeow.PairClientType, string) {
+	client, ok := pairClients[store.DeviceProps.GetPlatformType()]
+	if !ok {
+		client = pairClients[proto.DeviceProps_CHROME]
+	}
+	return client.clientType, fmt.Sprintf("%s (%s)", client.browser, store.DeviceProps.GetOs())
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+)
+
+// mediaCacheTTL is how long downloaded media is kept for retried downloads.
+const mediaCacheTTL = 5 * time.Minute
+
+// mediaCacheSize is the most bytes of downloaded media kept, the oldest
+// downloads make room for new ones.
+const mediaCacheSize = 64 << 20
+
+// mediaRef is everything needed to download and decrypt an attachment.
+type mediaRef struct {
+	Type          string `json:"type"`
+	Mimetype      string `json:"mimetype"`
+	FileName      string `json:"filename,omitempty"`
+	DirectPath    string `json:"directPath"`
+	MediaKey      []byte `json:"mediaKey"`
+	FileSha256    []byte `json:"fileSha256"`
+	FileEncSha256 []byte `json:"fileEncSha256"`
+	FileLength    uint64 `json:"fileLength"`
+}
+
+// mediaTypes maps mediaRef.Type to the media type of whatsmeow and to the
+// type the media servers know it by, stickers are handled like images.
+var mediaTypes = map[string]struct {
+	mediaType whatsmeow.MediaType
+	mmsType   string
+}{
+	"image":    {whatsmeow.MediaImage, "image"},
+	"sticker":  {whatsmeow.MediaImage, "image"},
+	"video":    {whatsmeow.MediaVideo, "video"},
+	"audio":    {whatsmeow.MediaAudio, "audio"},
+	"document": {whatsmeow.MediaDocument, "document"},
+}
+
+// mediaMessage is implemented by all the attachment messages.
+type mediaMessage interface {
+	GetMimetype() string
+	GetDirectPath() string
+	GetMediaKey() []byte
+	GetFileSha256() []byte
+	GetFileEncSha256() []byte
+	GetFileLength() uint64
+}
+
+// newMediaRef returns the reference to the attachment of msg, or nil if it
+// has none.
+func newMediaRef(msg *proto.Message) *mediaRef {
+	if wrapped := msg.GetDocumentWithCaptionMessage().GetMessage(); wrapped != nil {
+		msg = wrapped
+	}
+	var kind, fileName string
+	var media mediaMessage
+	switch {
+	case msg.GetImageMessage() != nil:
+		kind, media = "image", msg.GetImageMessage()
+	case msg.GetStickerMessage() != nil:
+		kind, media = "sticker", msg.GetStickerMessage()
+	case msg.GetVideoMessage() != nil:
+		kind, media = "video", msg.GetVideoMessage()
+	case msg.GetAudioMessage() != nil:
+		kind, media = "audio", msg.GetAudioMessage()
+	case msg.GetDocumentMessage() != nil:
+		kind, media = "document", msg.GetDocumentMessage()
+		fileName = msg.GetDocumentMessage().GetFileName()
+	default:
+		return nil
+	}
+	return &mediaRef{
+		Type:          kind,
+		Mimetype:      media.GetMimetype(),
+		FileName:      fileName,
+		DirectPath:    media.GetDirectPath(),
+		MediaKey:      media.GetMediaKey(),
+		FileSha256:    media.GetFileSha256(),
+		FileEncSha256: media.GetFileEncSha256(),
+		FileLength:    media.GetFileLength(),
+	}
+}
+
+type cachedMedia struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// mediaCache keeps recent downloads by the hash of their encrypted file and
+// the key they were decrypted with, at most mediaCacheSize bytes of them.
+var mediaCache = struct {
+	lock  sync.Mutex
+	byKey map[string]*list.Element
+	// order has the oldest entry at the front
+	order *list.List
+	size  int
+}{byKey: map[string]*list.Element{}, order: list.New()}
+
+// mediaCacheKey identifies a download, the plaintext is only handed out to
+// callers which know the media key.
+func mediaCacheKey(ref *mediaRef) string {
+	return hex.EncodeToString(ref.FileEncSha256) + ":" + hex.EncodeToString(ref.MediaKey)
+}
+
+func cachedDownload(key string) []byte {
+	mediaCache.lock.Lock()
+	defer mediaCache.lock.Unlock()
+	element, ok := mediaCache.byKey[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cachedMedia)
+	if time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.data
+}
+
+func cacheDownload(key string, data []byte) {
+	if len(data) > mediaCacheSize {
+		return
+	}
+	mediaCache.lock.Lock()
+	defer mediaCache.lock.Unlock()
+	if element, ok := mediaCache.byKey[key]; ok {
+		removeCachedMedia(element)
+	}
+	now := time.Now()
+	for element := mediaCache.order.Front(); element != nil; element = mediaCache.order.Front() {
+		entry := element.Value.(*cachedMedia)
+		if mediaCache.size+len(data) <= mediaCacheSize && !now.After(entry.expires) {
+			break
+		}
+		removeCachedMedia(element)
+	}
+	mediaCache.byKey[key] = mediaCache.order.PushBack(&cachedMedia{key: key, data: data, expires: now.Add(mediaCacheTTL)})
+	mediaCache.size += len(data)
+}
+
+func removeCachedMedia(element *list.Element) {
+	entry := mediaCache.order.Remove(element).(*cachedMedia)
+	delete(mediaCache.byKey, entry.key)
+	mediaCache.size -= len(entry.data)
+}
+
+// handleMediaDownload decrypts the attachment of a received message, given
+// the media reference of the webhook payload as the JSON body.
+func handleMediaDownload(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(sess, r, r.URL.Query().Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ref := &mediaRef{}
+		if err := json.NewDecoder(r.Body).Decode(ref); err != nil {
+			bodyError(w, fmt.Errorf("invalid json body: %w", err))
+			return
+		}
+		kind, ok := mediaTypes[ref.Type]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("type must be one of image, sticker, video, audio or document"))
+			return
+		}
+		if ref.DirectPath == "" || len(ref.MediaKey) == 0 || len(ref.FileEncSha256) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("directPath, mediaKey and fileEncSha256 are required"))
+			return
+		}
+		cacheKey := mediaCacheKey(ref)
+		data := cachedDownload(cacheKey)
+		if data == nil {
+			var err error
+			data, err = sess.Client().DownloadMediaWithPath(ref.DirectPath, ref.FileEncSha256, ref.FileSha256, ref.MediaKey, int(ref.FileLength), kind.mediaType, kind.mmsType)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			cacheDownload(cacheKey, data)
+		}
+		mimetype := ref.Mimetype
+		if mimetype == "" {
+			mimetype = http.DetectContentType(data)
+		}
+		if ref.FileName != "" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ref.FileName))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", mimetype)
+		_, _ = w.Write(data)
+	}
+}
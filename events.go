@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventBuffer is how many events a websocket client may fall behind
+	// before it is disconnected.
+	eventBuffer   = 64
+	wsPingPeriod  = 30 * time.Second
+	wsWriteWait   = 10 * time.Second
+	wsPongTimeout = wsPingPeriod + wsWriteWait
+)
+
+// eventHub fans the events of a session out to its websocket clients.
+type eventHub struct {
+	lock    sync.Mutex
+	clients map[chan []byte]bool
+}
+
+func (h *eventHub) subscribe() chan []byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.clients == nil {
+		h.clients = map[chan []byte]bool{}
+	}
+	ch := make(chan []byte, eventBuffer)
+	h.clients[ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.clients[ch] {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// listening tells whether any client is subscribed, so events need not be
+// built for nobody.
+func (h *eventHub) listening() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.clients) > 0
+}
+
+// publish sends event to every client, the ones too slow to keep up are
+// dropped rather than holding up the session.
+func (h *eventHub) publish(event interface{}) {
+	if !h.listening() {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		mainLog.Errorf("Error encoding event: %s", err)
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- data:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+type statePayload struct {
+	Type      string `json:"type"`
+	Session   string `json:"session"`
+	LoggedIn  bool   `json:"loggedIn"`
+	QRCode    string `json:"qrCode,omitempty"`
+	QRExpires int64  `json:"qrExpires,omitempty"`
+	QRExpired bool   `json:"qrExpired,omitempty"`
+}
+
+func (s *session) statePayload() *statePayload {
+	state := s.state.Snapshot()
+	payload := &statePayload{
+		Type:      "state",
+		Session:   s.name,
+		LoggedIn:  state.Ready,
+		QRCode:    state.QRCode,
+		QRExpired: state.QRExpired,
+	}
+	if state.QRCode != "" {
+		payload.QRExpires = state.QRExpires.Unix()
+	}
+	return payload
+}
+
+// eventMessage is an incoming message as the websocket clients get it, the
+// webhook payload tagged with its type.
+type eventMessage struct {
+	Type string `json:"type"`
+	*messagePayload
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkWebsocketOrigin}
+
+// checkWebsocketOrigin accepts browsers on the same host and the origins of
+// -cors-origins.
+func checkWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range splitList(corsOrigins) {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleEvents streams the state, QR codes, lifecycle events and incoming
+// messages of the session over a websocket. The current state comes first,
+// browsers can only authenticate with the key query parameter.
+func handleEvents(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(sess, r, r.URL.Query().Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has answered already
+			return
+		}
+		defer conn.Close()
+		events := sess.events.subscribe()
+		defer sess.events.unsubscribe(events)
+		// clients have nothing to say, reading only handles the pongs and
+		// notices when they go away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			conn.SetReadLimit(512)
+			_ = conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			})
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err = conn.WriteJSON(sess.statePayload()); err != nil {
+			return
+		}
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case data, ok := <-events:
+				_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if !ok {
+					_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+					return
+				}
+				if err = conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					return
+				}
+			case <-ticker.C:
+				_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err = conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			case <-shuttingDown:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const groupCacheTTL = time.Minute
+
+var errUnknownGroup = errors.New("no joined group with that name")
+
+// joinedGroups returns the groups the session is in, served from a short
+// lived cache unless fresh is set.
+func (s *session) joinedGroups(fresh bool) ([]*types.GroupInfo, error) {
+	s.lock.RLock()
+	groups, fetched := s.groups, s.groupsFetched
+	s.lock.RUnlock()
+	if !fresh && groups != nil && time.Since(fetched) < groupCacheTTL {
+		return groups, nil
+	}
+	groups, err := s.Client().GetJoinedGroups()
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.groups = groups
+	s.groupsFetched = time.Now()
+	s.lock.Unlock()
+	return groups, nil
+}
+
+// forgetGroups drops the cached groups after joining or leaving one.
+func (s *session) forgetGroups() {
+	s.lock.Lock()
+	s.groups = nil
+	s.lock.Unlock()
+}
+
+// resolveGroup finds the JID of a joined group by its name.
+func (s *session) resolveGroup(name string) (types.JID, error) {
+	groups, err := s.joinedGroups(false)
+	if err != nil {
+		return types.JID{}, fmt.Errorf("failed to list groups: %w", err)
+	}
+	var found []types.JID
+	for _, group := range groups {
+		if strings.EqualFold(group.Name, name) {
+			found = append(found, group.JID)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return types.JID{}, fmt.Errorf("%w: %s", errUnknownGroup, name)
+	case 1:
+		return found[0], nil
+	default:
+		return types.JID{}, fmt.Errorf("%w: %q matches %d groups, use the group jid instead", errUnknownGroup, name, len(found))
+	}
+}
+
+func handleGroups(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		groups, err := sess.joinedGroups(true)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(groups))
+		for _, group := range groups {
+			result = append(result, map[string]interface{}{
+				"jid":          group.JID.String(),
+				"name":         group.Name,
+				"participants": len(group.Participants),
+			})
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// handleCreateGroup creates a group with the given name and participant
+// numbers. Numbers which are invalid or not on WhatsApp are left out, the
+// response lists them along with the participants WhatsApp refused to add.
+func handleCreateGroup(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		name := strings.TrimSpace(r.Form.Get("name"))
+		if name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("name is required"))
+			return
+		}
+		var numbers []string
+		for _, value := range r.Form["participants"] {
+			numbers = append(numbers, splitList(value)...)
+		}
+		if len(numbers) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("participants is required"))
+			return
+		}
+		participants, rejected, err := sess.resolveParticipants(numbers)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if len(participants) == 0 {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"error":    "none of the participants can be added",
+				"rejected": rejected,
+			})
+			return
+		}
+		group, err := sess.Client().CreateGroup(whatsmeow.ReqCreateGroup{
+			Name:         name,
+			Participants: participants,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		for _, participant := range group.Participants {
+			if participant.Error != 0 {
+				rejected = append(rejected, map[string]interface{}{
+					"participant": participant.JID.String(),
+					"error":       fmt.Sprintf("could not be added (error %d)", participant.Error),
+				})
+			}
+		}
+		sess.forgetGroups()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"jid":      group.JID.String(),
+			"name":     group.Name,
+			"rejected": rejected,
+		})
+	}
+}
+
+// resolveParticipants turns phone numbers into the JIDs of their accounts,
+// the numbers which are invalid or not on WhatsApp are returned as rejected
+// along with the reason.
+func (s *session) resolveParticipants(numbers []string) ([]types.JID, []map[string]interface{}, error) {
+	rejected := make([]map[string]interface{}, 0)
+	var phones []string
+	for _, number := range numbers {
+		if digits := phoneDigits(number); digits != "" {
+			phones = append(phones, "+"+digits)
+		} else {
+			rejected = append(rejected, map[string]interface{}{"participant": number, "error": "invalid phone number"})
+		}
+	}
+	var participants []types.JID
+	if len(phones) > 0 {
+		resp, err := s.Client().IsOnWhatsApp(phones)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, item := range resp {
+			if item.IsIn {
+				participants = append(participants, item.JID)
+			} else {
+				rejected = append(rejected, map[string]interface{}{"participant": item.Query, "error": errNotOnWhatsApp.Error()})
+			}
+		}
+	}
+	return participants, rejected, nil
+}
+
+// groupError answers a failed group operation with the status matching the
+// error WhatsApp returned.
+func groupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, whatsmeow.ErrGroupNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, whatsmeow.ErrNotInGroup), errors.Is(err, whatsmeow.ErrGroupInviteLinkUnauthorized),
+		errors.Is(err, whatsmeow.ErrIQForbidden), errors.Is(err, whatsmeow.ErrIQNotAuthorized):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, whatsmeow.ErrInviteLinkInvalid), errors.Is(err, whatsmeow.ErrInviteLinkRevoked):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_, _ = w.Write([]byte(err.Error()))
+}
+
+// handleGroup serves /groups/{jid}/{action}, the server part of the group
+// jid may be left out.
+func handleGroup(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		jidStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/groups/"), "/")
+		if !strings.Contains(jidStr, "@") {
+			jidStr += "@" + types.GroupServer
+		}
+		jid, err := types.ParseJID(jidStr)
+		if err != nil || jid.Server != types.GroupServer {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid group jid"))
+			return
+		}
+		switch action {
+		case "":
+			groupDetails(w, sess, jid)
+		case "invite":
+			groupInvite(w, r, sess, jid)
+		case "participants":
+			groupParticipants(w, r, sess, jid)
+		case "leave":
+			leaveGroup(w, r, sess, jid)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("404 page not found"))
+		}
+	}
+}
+
+// groupDetails returns the metadata of a group along with its participants.
+func groupDetails(w http.ResponseWriter, sess *session, group types.JID) {
+	info, err := sess.Client().GetGroupInfo(group)
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	participants := make([]map[string]interface{}, 0, len(info.Participants))
+	for _, participant := range info.Participants {
+		participants = append(participants, map[string]interface{}{
+			"jid":          participant.JID.String(),
+			"isAdmin":      participant.IsAdmin || participant.IsSuperAdmin,
+			"isSuperAdmin": participant.IsSuperAdmin,
+		})
+	}
+	result := map[string]interface{}{
+		"jid":          info.JID.String(),
+		"name":         info.Name,
+		"topic":        info.Topic,
+		"owner":        "",
+		"created":      info.GroupCreated.Unix(),
+		"participants": participants,
+		"settings": map[string]interface{}{
+			// locked groups only let admins edit the group info, announce
+			// groups only let admins send messages
+			"locked":            info.IsLocked,
+			"announce":          info.IsAnnounce,
+			"ephemeral":         info.IsEphemeral,
+			"disappearingTimer": info.DisappearingTimer,
+			"memberAddMode":     string(info.MemberAddMode),
+		},
+	}
+	if !info.OwnerJID.IsEmpty() {
+		result["owner"] = info.OwnerJID.String()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// isGroupAdmin tells whether the session is an admin of the group.
+func (s *session) isGroupAdmin(group types.JID) (bool, error) {
+	cli := s.Client()
+	info, err := cli.GetGroupInfo(group)
+	if err != nil {
+		return false, err
+	}
+	for _, participant := range info.Participants {
+		if participant.JID.User == cli.Store.ID.User {
+			return participant.IsAdmin || participant.IsSuperAdmin, nil
+		}
+	}
+	return false, nil
+}
+
+// groupParticipants changes the participants of a group: POST adds the
+// numbers, DELETE removes them and PUT promotes them to admins or, with
+// action=demote, demotes them. The outcome is listed for every participant
+// since WhatsApp may refuse some of them, e.g. for their privacy settings.
+func groupParticipants(w http.ResponseWriter, r *http.Request, sess *session, group types.JID) {
+	var change whatsmeow.ParticipantChange
+	switch r.Method {
+	case http.MethodPost:
+		change = whatsmeow.ParticipantChangeAdd
+	case http.MethodDelete:
+		change = whatsmeow.ParticipantChangeRemove
+	case http.MethodPut:
+		switch r.Form.Get("action") {
+		case "", "promote":
+			change = whatsmeow.ParticipantChangePromote
+		case "demote":
+			change = whatsmeow.ParticipantChangeDemote
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("action must be promote or demote"))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var numbers []string
+	for _, value := range r.Form["participants"] {
+		numbers = append(numbers, splitList(value)...)
+	}
+	if len(numbers) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("participants is required"))
+		return
+	}
+	admin, err := sess.isGroupAdmin(group)
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	if !admin {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("only group admins can change the participants"))
+		return
+	}
+	participants, rejected, err := sess.resolveParticipants(numbers)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if len(participants) == 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    "none of the participants can be changed",
+			"rejected": rejected,
+		})
+		return
+	}
+	changed, err := sess.Client().UpdateGroupParticipants(group, participants, change)
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	results := make([]map[string]interface{}, 0, len(changed))
+	for _, participant := range changed {
+		result := map[string]interface{}{
+			"participant": participant.JID.String(),
+			"success":     participant.Error == 0,
+		}
+		if participant.Error != 0 {
+			// e.g. 403 for privacy settings, 409 for members already in
+			// the group and 404 for ones which are not
+			result["error"] = participant.Error
+		}
+		results = append(results, result)
+	}
+	sess.forgetGroups()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"action":   string(change),
+		"results":  results,
+		"rejected": rejected,
+	})
+}
+
+// leaveGroup leaves a group. WhatsApp may refuse it, e.g. for the last
+// admin of a community, the error is passed on as it is.
+func leaveGroup(w http.ResponseWriter, r *http.Request, sess *session, group types.JID) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := sess.Client().LeaveGroup(group); err != nil {
+		groupError(w, err)
+		return
+	}
+	sess.forgetGroups()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jid":  group.String(),
+		"left": true,
+	})
+}
+
+// groupInvite returns the invite link of a group, reset=true revokes the
+// current link and returns a new one.
+func groupInvite(w http.ResponseWriter, r *http.Request, sess *session, group types.JID) {
+	reset, err := formBool(r, "reset")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	admin, err := sess.isGroupAdmin(group)
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	if !admin {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("only group admins can manage the invite link"))
+		return
+	}
+	link, err := sess.Client().GetGroupInviteLink(group, reset)
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"link": link,
+		"code": strings.TrimPrefix(link, whatsmeow.InviteLinkPrefix),
+	})
+}
+
+// handleJoinGroup joins a group with an invite link or its bare code. Being
+// a member already is not an error, the group is returned all the same.
+func handleJoinGroup(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		code := r.Form.Get("link")
+		if code == "" {
+			code = r.Form.Get("code")
+		}
+		code = strings.TrimPrefix(strings.TrimSpace(code), whatsmeow.InviteLinkPrefix)
+		if code == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("link or code is required"))
+			return
+		}
+		cli := sess.Client()
+		info, err := cli.GetGroupInfoFromLink(code)
+		if err != nil {
+			groupError(w, err)
+			return
+		}
+		for _, participant := range info.Participants {
+			if participant.JID.User == cli.Store.ID.User {
+				writeJSON(w, http.StatusOK, map[string]interface{}{
+					"jid":           info.JID.String(),
+					"name":          info.Name,
+					"alreadyMember": true,
+				})
+				return
+			}
+		}
+		jid, err := cli.JoinGroupWithLink(code)
+		if err != nil {
+			groupError(w, err)
+			return
+		}
+		sess.forgetGroups()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"jid":           jid.String(),
+			"name":          info.Name,
+			"alreadyMember": false,
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// statusFailed marks the history entries of messages which could not be
+// sent, next to the statuses of status.go.
+const statusFailed = "failed"
+
+func upgradeHistory() error {
+	idType := dbColumns.id
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS sent_messages (
+		id         ` + idType + ` PRIMARY KEY,
+		session    TEXT    NOT NULL,
+		message_id TEXT    NOT NULL,
+		recipient  TEXT    NOT NULL,
+		type       TEXT    NOT NULL,
+		status     TEXT    NOT NULL,
+		created_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS sent_messages_recipient ON sent_messages (session, recipient, id)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS sent_messages_message ON sent_messages (message_id)`)
+	return err
+}
+
+// messageKind names the type of msg for the history.
+func messageKind(msg *proto.Message) string {
+	if ref := newMediaRef(msg); ref != nil {
+		return ref.Type
+	}
+	switch {
+	case msg.GetConversation() != "" || msg.GetExtendedTextMessage() != nil:
+		return "text"
+	case msg.GetLocationMessage() != nil:
+		return "location"
+	case msg.GetContactMessage() != nil || msg.GetContactsArrayMessage() != nil:
+		return "contact"
+	case pollCreation(msg) != nil:
+		return "poll"
+	case msg.GetPollUpdateMessage() != nil:
+		return "vote"
+	case msg.GetReactionMessage() != nil:
+		return "reaction"
+	case msg.GetButtonsMessage() != nil:
+		return "buttons"
+	case msg.GetListMessage() != nil:
+		return "list"
+	case msg.GetProtocolMessage().GetType() == proto.ProtocolMessage_REVOKE:
+		return "revoke"
+	case msg.GetProtocolMessage().GetType() == proto.ProtocolMessage_MESSAGE_EDIT:
+		return "edit"
+	default:
+		return "other"
+	}
+}
+
+// recordSent adds a send, successful or not, to the history.
+func (s *session) recordSent(to types.JID, id types.MessageID, msg *proto.Message, status string) {
+	_, err := db.Exec(
+		`INSERT INTO sent_messages (session, message_id, recipient, type, status, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		s.name, id, to.String(), messageKind(msg), status, time.Now().Unix(),
+	)
+	if err != nil {
+		s.log.Errorf("Error recording sent message %s: %s", id, err)
+	}
+}
+
+// recordReceipt moves the history entries of the messages of evt forward,
+// never back, as trackReceipt does.
+func (s *session) recordReceipt(evt *events.Receipt) {
+	for _, id := range evt.MessageIDs {
+		var err error
+		switch evt.Type {
+		case types.ReceiptTypeDelivered:
+			_, err = db.Exec(
+				`UPDATE sent_messages SET status=$1 WHERE session=$2 AND message_id=$3 AND status=$4`,
+				statusDelivered, s.name, id, statusSent,
+			)
+		case types.ReceiptTypeRead, types.ReceiptTypePlayed:
+			_, err = db.Exec(
+				`UPDATE sent_messages SET status=$1 WHERE session=$2 AND message_id=$3 AND status<>$1`,
+				statusRead, s.name, id,
+			)
+		default:
+			return
+		}
+		if err != nil {
+			s.log.Errorf("Error updating sent message %s: %s", id, err)
+		}
+	}
+}
+
+type historyEntry struct {
+	ID        string `json:"id"`
+	To        string `json:"to"`
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// handleHistory lists the latest sends to a destination, newest first. The
+// next page continues from the before cursor of the previous one.
+func handleHistory(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if r.Form.Get("to") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("to is required"))
+			return
+		}
+		jid, err := normalizeJID(r.Form.Get("to"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		limit := defaultHistoryLimit
+		if value := r.Form.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxHistoryLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("limit must be between 1 and " + strconv.Itoa(maxHistoryLimit)))
+				return
+			}
+		}
+		// the cursor is the row id, message ids do not sort
+		before := int64(-1)
+		if value := r.Form.Get("before"); value != "" {
+			before, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || before < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid before cursor"))
+				return
+			}
+		}
+		query := `SELECT id, message_id, type, status, created_at FROM sent_messages WHERE session=$1 AND recipient=$2`
+		args := []interface{}{sess.name, jid.String()}
+		if before >= 0 {
+			query += ` AND id<$3`
+			args = append(args, before)
+		}
+		// placeholders are numbered in the order they appear, SQLite binds
+		// them by position
+		args = append(args, limit+1)
+		rows, err := db.Query(query+` ORDER BY id DESC LIMIT $`+strconv.Itoa(len(args)), args...)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		defer rows.Close()
+		entries := make([]historyEntry, 0, limit)
+		var last int64
+		more := false
+		for rows.Next() {
+			if len(entries) == limit {
+				more = true
+				break
+			}
+			var entry historyEntry
+			var created int64
+			if err = rows.Scan(&last, &entry.ID, &entry.Type, &entry.Status, &created); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			entry.To = jid.String()
+			entry.Timestamp = time.Unix(created, 0).UTC().Format(time.RFC3339)
+			entries = append(entries, entry)
+		}
+		if err = rows.Err(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		result := map[string]interface{}{
+			"messages": entries,
+		}
+		if more {
+			result["before"] = strconv.FormatInt(last, 10)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey bounds the length of Idempotency-Key headers kept.
+const maxIdempotencyKey = 255
+
+// storedResponse is the response to a request with an Idempotency-Key,
+// done is closed once it is complete.
+type storedResponse struct {
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotency keeps the successful responses to requests with an
+// Idempotency-Key for -idempotency-ttl, keyed by session, API key and header
+// value.
+var idempotency = struct {
+	lock      sync.Mutex
+	byKey     map[string]*storedResponse
+	lastSweep time.Time
+}{byKey: map[string]*storedResponse{}}
+
+// responseCapture copies what is written through it into a storedResponse.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+var (
+	// errMultipartKey is returned by requestKey for multipart bodies without
+	// a key in the query or Basic auth, the body is not read to look for one.
+	errMultipartKey = errors.New("multipart requests with an Idempotency-Key need the key in the query or Basic auth")
+	// errPeekUnauthorized is returned by requestKey for multipart bodies
+	// whose caller is not authorized by the query or Basic auth.
+	errPeekUnauthorized = errors.New("unauthorized")
+)
+
+// requestKey peeks at the API key and the dryRun flag of a send request
+// without using up its body, JSON bodies are buffered for the handler to
+// read again. Multipart bodies may be large uploads, they are only read once
+// the key of the query or Basic auth is authorized, like /send/batch does.
+func requestKey(sess *session, r *http.Request) (string, bool, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", false, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		var peek struct {
+			Key    string `json:"key"`
+			DryRun bool   `json:"dryRun"`
+		}
+		// batches are plain arrays, their key comes with the query
+		_ = json.Unmarshal(data, &peek)
+		if peek.Key == "" {
+			peek.Key = r.URL.Query().Get("key")
+		}
+		return peek.Key, peek.DryRun, nil
+	case "multipart/form-data":
+		key := r.URL.Query().Get("key")
+		if _, _, basic := r.BasicAuth(); key == "" && !basic {
+			return "", false, errMultipartKey
+		}
+		if authorize(sess, r, key) == nil {
+			return "", false, errPeekUnauthorized
+		}
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return "", false, err
+		}
+		dryRun, err := formBool(r, "dryRun")
+		return key, dryRun, err
+	default:
+		if err := r.ParseForm(); err != nil {
+			return "", false, err
+		}
+	}
+	dryRun, err := formBool(r, "dryRun")
+	return r.Form.Get("key"), dryRun, err
+}
+
+// idempotent replays the stored response when a request repeats the
+// Idempotency-Key of an earlier one instead of sending again. A repeat which
+// arrives while the first request is still running waits for it, failed
+// requests and dry runs are not stored so they can be retried. The caller is
+// authorized before anything is replayed, and responses are only replayed
+// to the API key they were made for. Multipart uploads have to carry the key
+// in the query or Basic auth, they are refused rather than sent without the
+// protection.
+func idempotent(sess *session, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || len(key) > maxIdempotencyKey || idempotencyTTL <= 0 {
+			h(w, r)
+			return
+		}
+		apiKey, dryRun, err := requestKey(sess, r)
+		if errors.Is(err, errMultipartKey) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil && !errors.Is(err, errPeekUnauthorized) || dryRun {
+			// the handler answers unreadable bodies
+			h(w, r)
+			return
+		}
+		if err != nil || authorize(sess, r, apiKey) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if apiKey == "" {
+			_, apiKey, _ = r.BasicAuth()
+		}
+		key = sess.name + "\x00" + apiKey + "\x00" + key
+		var own *storedResponse
+		for own == nil {
+			idempotency.lock.Lock()
+			now := time.Now()
+			sweepIdempotency(now)
+			stored, ok := idempotency.byKey[key]
+			if !ok || !stored.expires.IsZero() && now.After(stored.expires) {
+				own = &storedResponse{done: make(chan struct{})}
+				idempotency.byKey[key] = own
+				idempotency.lock.Unlock()
+				continue
+			}
+			idempotency.lock.Unlock()
+			<-stored.done
+			if stored.status == 0 {
+				// the first request failed and gave the key up, try again
+				continue
+			}
+			for name, values := range stored.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			_, _ = w.Write(stored.body)
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		defer func() {
+			idempotency.lock.Lock()
+			stored := own
+			if capture.status >= 200 && capture.status < 300 {
+				stored.status = capture.status
+				stored.header = capture.Header().Clone()
+				// every request keeps its own id
+				stored.header.Del("X-Request-ID")
+				stored.body = capture.body.Bytes()
+				stored.expires = time.Now().Add(idempotencyTTL)
+			} else {
+				delete(idempotency.byKey, key)
+			}
+			idempotency.lock.Unlock()
+			close(stored.done)
+		}()
+		h(capture, r)
+	}
+}
+
+// sweepIdempotency drops the expired responses, it must be called with the
+// lock held.
+func sweepIdempotency(now time.Time) {
+	if now.Sub(idempotency.lastSweep) < time.Minute {
+		return
+	}
+	idempotency.lastSweep = now
+	for key, stored := range idempotency.byKey {
+		if !stored.expires.IsZero() && now.After(stored.expires) {
+			delete(idempotency.byKey, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// maxButtons is the most quick reply buttons WhatsApp shows on a message.
+const maxButtons = 3
+
+// button is a quick reply button of /send/buttons, ID is what the webhook
+// receives when it is tapped.
+type button struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+func handleSendButtons(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		if req.Text == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("text is required"))
+			return
+		}
+		if len(req.Buttons) == 0 || len(req.Buttons) > maxButtons {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("between 1 and 3 buttons are required"))
+			return
+		}
+		buttons := make([]*proto.ButtonsMessage_Button, 0, len(req.Buttons))
+		seen := make(map[string]bool, len(req.Buttons))
+		for _, b := range req.Buttons {
+			b.ID, b.Text = strings.TrimSpace(b.ID), strings.TrimSpace(b.Text)
+			if b.ID == "" {
+				b.ID = b.Text
+			}
+			if b.Text == "" || seen[b.ID] {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("buttons need a text and distinct ids"))
+				return
+			}
+			seen[b.ID] = true
+			buttons = append(buttons, &proto.ButtonsMessage_Button{
+				ButtonId:   gproto.String(b.ID),
+				ButtonText: &proto.ButtonsMessage_Button_ButtonText{DisplayText: gproto.String(b.Text)},
+				Type:       proto.ButtonsMessage_Button_RESPONSE.Enum(),
+			})
+		}
+		msg := &proto.ButtonsMessage{
+			ContentText: gproto.String(req.Text),
+			Buttons:     buttons,
+			HeaderType:  proto.ButtonsMessage_EMPTY.Enum(),
+		}
+		if req.Footer != "" {
+			msg.FooterText = gproto.String(req.Footer)
+		}
+		deliver(w, r, sess, jid, &proto.Message{ButtonsMessage: msg})
+	}
+}
+
+// maxListRows is the most rows WhatsApp shows in a list, across sections.
+const maxListRows = 10
+
+// listSection is a titled group of rows of /send/list.
+type listSection struct {
+	Title string    `json:"title"`
+	Rows  []listRow `json:"rows"`
+}
+
+// listRow is an entry of a list, ID is what the webhook receives when it is
+// selected.
+type listRow struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func handleSendList(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		if req.Text == "" || req.ButtonText == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("text and buttonText are required"))
+			return
+		}
+		sections := make([]*proto.ListMessage_Section, 0, len(req.Sections))
+		seen := make(map[string]bool)
+		for _, section := range req.Sections {
+			rows := make([]*proto.ListMessage_Row, 0, len(section.Rows))
+			for _, row := range section.Rows {
+				row.ID, row.Title = strings.TrimSpace(row.ID), strings.TrimSpace(row.Title)
+				if row.ID == "" {
+					row.ID = row.Title
+				}
+				if row.Title == "" || seen[row.ID] {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte("rows need a title and distinct ids"))
+					return
+				}
+				seen[row.ID] = true
+				entry := &proto.ListMessage_Row{
+					RowId: gproto.String(row.ID),
+					Title: gproto.String(row.Title),
+				}
+				if row.Description != "" {
+					entry.Description = gproto.String(row.Description)
+				}
+				rows = append(rows, entry)
+			}
+			sections = append(sections, &proto.ListMessage_Section{
+				Title: gproto.String(section.Title),
+				Rows:  rows,
+			})
+		}
+		if len(seen) == 0 || len(seen) > maxListRows {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("between 1 and 10 rows are required"))
+			return
+		}
+		msg := &proto.ListMessage{
+			Title:       gproto.String(req.Title),
+			Description: gproto.String(req.Text),
+			ButtonText:  gproto.String(req.ButtonText),
+			ListType:    proto.ListMessage_SINGLE_SELECT.Enum(),
+			Sections:    sections,
+		}
+		if req.Footer != "" {
+			msg.FooterText = gproto.String(req.Footer)
+		}
+		deliver(w, r, sess, jid, &proto.Message{ListMessage: msg})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// mainLog is the logger of the service itself, set up once the flags are parsed.
+var mainLog waLog.Logger
+
+// newLogger returns a logger for module in the format chosen by -log-format.
+func newLogger(module string) waLog.Logger {
+	if logFormat == "json" {
+		return &jsonLogger{mod: module}
+	}
+	return waLog.Stdout(module, "INFO", true)
+}
+
+var jsonLevels = map[string]int{
+	"DEBUG": 0,
+	"INFO":  1,
+	"WARN":  2,
+	"ERROR": 3,
+}
+
+var jsonOutput sync.Mutex
+
+// jsonLogger writes one JSON object per line to stdout, for log aggregation.
+type jsonLogger struct {
+	mod string
+}
+
+func (l *jsonLogger) outputf(level, msg string, args ...interface{}) {
+	if jsonLevels[level] < jsonLevels["INFO"] {
+		return
+	}
+	line, err := json.Marshal(map[string]string{
+		"time":    time.Now().Format(time.RFC3339Nano),
+		"level":   level,
+		"module":  l.mod,
+		"message": fmt.Sprintf(msg, args...),
+	})
+	if err != nil {
+		return
+	}
+	jsonOutput.Lock()
+	defer jsonOutput.Unlock()
+	_, _ = os.Stdout.Write(append(line, '\n'))
+}
+
+func (l *jsonLogger) Errorf(msg string, args ...interface{}) { l.outputf("ERROR", msg, args...) }
+func (l *jsonLogger) Warnf(msg string, args ...interface{})  { l.outputf("WARN", msg, args...) }
+func (l *jsonLogger) Infof(msg string, args ...interface{})  { l.outputf("INFO", msg, args...) }
+func (l *jsonLogger) Debugf(msg string, args ...interface{}) { l.outputf("DEBUG", msg, args...) }
+func (l *jsonLogger) Sub(mod string) waLog.Logger {
+	return &jsonLogger{mod: fmt.Sprintf("%s/%s", l.mod, mod)}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"go.mau.fi/whatsmeow/types"
-	"go.mau.fi/whatsmeow/types/events"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,213 +13,579 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/skip2/go-qrcode"
-	"go.mau.fi/whatsmeow"
-	"go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/store/sqlstore"
-	waLog "go.mau.fi/whatsmeow/util/log"
-
-	_ "github.com/glebarez/sqlite"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-var readyState = struct {
-	ready  bool
-	lock   sync.RWMutex
-	qrCode string
-}{}
-
 var (
-	httpServe string
-	serverKey string
-	dbPath    string
+	httpServe            string
+	serverKey            string
+	dbPath               string
+	dbDialect            string
+	webhook              string
+	sessionsSpec         string
+	statusTTL            time.Duration
+	checkNumbers         bool
+	shutdownTimeout      time.Duration
+	logFormat            string
+	metricsNoAuth        bool
+	rate                 string
+	globalRate           string
+	queueMode            bool
+	tlsCert              string
+	tlsKey               string
+	tlsAuto              string
+	tlsCache             string
+	keysFile             string
+	sendAttempts         int
+	sendBackoff          time.Duration
+	lifecycleWebhook     string
+	reconnectAttempts    int
+	reconnectDelay       time.Duration
+	reconnectMaxDelay    time.Duration
+	configFile           string
+	corsOrigins          string
+	idempotencyTTL       time.Duration
+	qrExpiry             string
+	maxBody              int64
+	contactsOnly         bool
+	deviceName           string
+	deviceVersion        string
+	devicePlatform       string
+	allowRaw             bool
+	qrStdout             bool
+	sendTimeout          time.Duration
+	templatesFile        string
+	dedupSize            int
+	replyTokenTTL        time.Duration
+	readTimeout          time.Duration
+	readHeaderTimeout    time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
+	queueURL             string
+	dbWait               time.Duration
+	webhookAllow         string
+	webhookBlock         string
+	dbJournalMode        string
+	dbBusyTimeout        time.Duration
+	dbMaxOpenConns       int
+	dbMaxIdleConns       int
+	waitDeliveredTimeout time.Duration
 )
 
+// inFlight counts the send requests being processed, shutdown waits for them
+// before disconnecting the clients.
+var inFlight sync.WaitGroup
+
+// shuttingDown is closed once shutdown begins, so the event streams of /ws
+// and /events, which never finish by themselves, let go of the server.
+var shuttingDown = make(chan struct{})
+
 func main() {
 	flag.StringVar(&httpServe, "http", ":8080", "HTTP server listen address")
 	flag.StringVar(&serverKey, "key", "", "HTTP server key")
-	flag.StringVar(&dbPath, "db", "messages.db", "Database path")
+	flag.StringVar(&dbPath, "db", "messages.db", "Database path, or the connection string with -db-dialect postgres")
+	flag.StringVar(&dbDialect, "db-dialect", "sqlite", "Database type, one of the drivers built in: sqlite or postgres by default")
+	flag.StringVar(&dbJournalMode, "db-journal-mode", "wal", "SQLite journal mode, one of wal, delete, truncate, persist, memory or off")
+	flag.DurationVar(&dbBusyTimeout, "db-busy-timeout", 5*time.Second, "How long SQLite waits for a locked database before failing")
+	flag.IntVar(&dbMaxOpenConns, "db-max-open-conns", 0, "Maximum number of open database connections, 0 for no limit")
+	flag.IntVar(&dbMaxIdleConns, "db-max-idle-conns", 2, "Maximum number of idle database connections kept open")
+	flag.StringVar(&webhook, "webhook", "", "URL to POST incoming messages to")
+	flag.IntVar(&dedupSize, "dedup-size", 1000, "How many incoming message ids to remember for dropping messages delivered twice, 0 to forward every delivery")
+	flag.StringVar(&webhookAllow, "webhook-allow", "", "Comma separated chat JID patterns and type:kind entries incoming messages must match to be posted to the webhook, e.g. *@g.us,type:text")
+	flag.StringVar(&webhookBlock, "webhook-block", "", "Comma separated chat JID patterns and type:kind entries of incoming messages not to post to the webhook, e.g. *@broadcast,type:reaction")
+	flag.DurationVar(&replyTokenTTL, "reply-token-ttl", time.Hour, "How long the replyToken of webhook payloads can be used with /send, 0 to leave it out")
+	flag.StringVar(&lifecycleWebhook, "lifecycle-webhook", "", "URL to POST connection lifecycle events to")
+	flag.DurationVar(&waitDeliveredTimeout, "wait-delivered-timeout", 30*time.Second, "How long /send with waitDelivered waits for the delivery receipt before answering 202")
+	flag.DurationVar(&statusTTL, "status-ttl", 24*time.Hour, "How long the delivery status of sent messages is kept")
+	flag.BoolVar(&contactsOnly, "contacts-only", false, "Only send to users in the contact store, keys can override it with contactsOnly")
+	flag.BoolVar(&allowRaw, "allow-raw", false, "Serve /send/raw, which sends serialized protobuf messages as they are")
+	flag.BoolVar(&checkNumbers, "check-numbers", false, "Check that phone numbers are on WhatsApp before sending")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "How long reading a request including its body may take")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "How long reading the headers of a request may take")
+	flag.DurationVar(&writeTimeout, "write-timeout", 90*time.Second, "How long handling a request may take until its response is written, event streams are exempt")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "How long idle keep-alive connections are kept open")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight sends on shutdown")
+	flag.StringVar(&logFormat, "log-format", "text", "Log output format, text or json")
+	flag.BoolVar(&metricsNoAuth, "metrics-no-auth", false, "Serve /metrics without requiring the server key")
+	flag.StringVar(&rate, "rate", "", "Send rate limit per destination, e.g. 10/minute")
+	flag.StringVar(&globalRate, "global-rate", "", "Send rate limit per session across all destinations, e.g. 60/minute")
+	flag.BoolVar(&queueMode, "queue", false, "Queue messages while disconnected and send them on reconnect")
+	flag.StringVar(&queueURL, "queue-url", "", "Redis list or NATS JetStream subject to take send requests from, e.g. redis://localhost:6379/0?key=waservice:send&reply=waservice:results or nats://localhost:4222?subject=waservice.send, rediss:// and tls:// connect over TLS")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, serves HTTPS together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&tlsAuto, "tls-auto", "", "Domain to obtain a Let's Encrypt certificate for automatically")
+	flag.StringVar(&tlsCache, "tls-cache", "certs", "Directory to cache the automatic certificates in")
+	flag.StringVar(&keysFile, "keys", "", "JSON or YAML file with additional API keys and their permissions")
+	flag.StringVar(&templatesFile, "templates", "", "JSON or YAML file with the message templates of /send/template by name")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are replayed, 0 to disable")
+	flag.IntVar(&sendAttempts, "send-attempts", 3, "How many times a message is tried when sending fails on a connection error")
+	flag.DurationVar(&sendBackoff, "send-backoff", time.Second, "Delay before the first send retry, doubled for every further one")
+	flag.DurationVar(&sendTimeout, "send-timeout", 30*time.Second, "How long a send may take including its retries before giving up, 0 for no limit")
+	flag.IntVar(&reconnectAttempts, "reconnect-attempts", 5, "How many times to try reconnecting a logged out session")
+	flag.DurationVar(&reconnectDelay, "reconnect-delay", 5*time.Second, "Delay before the first reconnect attempt, doubled for every further one")
+	flag.DurationVar(&dbWait, "db-wait", time.Minute, "How long to keep retrying the database connection at startup before giving up")
+	flag.DurationVar(&reconnectMaxDelay, "reconnect-max-delay", 5*time.Minute, "Upper bound of the delay between reconnect attempts")
+	flag.BoolVar(&qrStdout, "qr-stdout", false, "Print the QR codes to stdout while a session is not paired, for pairing over SSH")
+	flag.StringVar(&qrExpiry, "qr-expiry", "renew", "What to do once the last QR code expires unscanned, renew to request new codes or expire to answer 410 on /qr")
+	flag.Int64Var(&maxBody, "max-body", 32<<20, "Largest request body accepted in bytes, 0 for no limit")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "Comma separated origins allowed to call the API from a browser, * for any")
+	flag.StringVar(&deviceName, "device-name", "", "Name the phone lists the linked device with, e.g. MyApp-Prod")
+	flag.StringVar(&deviceVersion, "device-version", "", "Version shown along with -device-name, such as 1.2.3")
+	flag.StringVar(&devicePlatform, "device-platform", "", "Platform icon of the linked device, e.g. chrome, firefox, safari, edge or desktop")
+	flag.StringVar(&sessionsSpec, "sessions", "", "Comma separated sessions as name=jid, leave the jid out to pair a new device")
+
+	flag.StringVar(&configFile, "config", "", "JSON or YAML file with defaults for the other flags, keyed by flag name")
 
 	flag.Parse()
+	// flags win over WA_* environment variables, which win over -config
+	if configFile == "" {
+		configFile = os.Getenv("WA_CONFIG")
+	}
+	if err := applyConfig(configFile); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	dbLog := waLog.Stdout("Database", "INFO", true)
+	if logFormat != "text" && logFormat != "json" {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid -log-format %q, expected text or json\n", logFormat)
+		os.Exit(2)
+	}
+	if qrExpiry != "renew" && qrExpiry != "expire" {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid -qr-expiry %q, expected renew or expire\n", qrExpiry)
+		os.Exit(2)
+	}
+	if err := applyDeviceProps(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	driver := dbDrivers[dbDialect]
+	if driver == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid -db-dialect %q, expected one of %s\n", dbDialect, dbDialects())
+		os.Exit(2)
+	}
+	filter, err := newWebhookFilter(webhookAllow, webhookBlock)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	incomingFilter = filter
+	switch dbJournalMode {
+	case "wal", "delete", "truncate", "persist", "memory", "off":
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "invalid -db-journal-mode %q, expected wal, delete, truncate, persist, memory or off\n", dbJournalMode)
+		os.Exit(2)
+	}
+	if queueURL != "" {
+		if err := checkQueueURL(queueURL); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		_, _ = fmt.Fprintf(os.Stderr, "-tls-cert and -tls-key must be set together\n")
+		os.Exit(2)
+	}
+	mainLog = newLogger("Main")
+	initial, err := newSettings(serverKey, keysFile, templatesFile, rate, globalRate, nil)
+	if err != nil {
+		panic(err)
+	}
+	activeSettings.Store(initial)
+	registerMetrics()
+	dbLog := newLogger("Database")
 
-	// Make sure you add appropriate DB connector imports, e.g. github.com/mattn/go-sqlite3 for SQLite
-	container, err := sqlstore.New("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)", dbPath), dbLog)
+	dbColumns = driver.columns
+	db, err = openDB(driver, dbPath)
+	if err != nil {
+		panic(err)
+	}
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	err = waitForDB(db, dbWait)
 	if err != nil {
 		panic(err)
 	}
-	// If you want multiple sessions, remember their JIDs and use .GetDevice(jid) or .GetAllDevices() instead.
-	deviceStore, err := container.GetFirstDevice()
+	container = sqlstore.NewWithDB(db, driver.dialect, dbLog)
+	err = container.Upgrade()
+	if err != nil {
+		panic(err)
+	}
+	err = upgradePolls()
+	if err != nil {
+		panic(err)
+	}
+	err = upgradeSchedule()
+	if err != nil {
+		panic(err)
+	}
+	err = upgradeBatches()
+	if err != nil {
+		panic(err)
+	}
+	err = upgradeHistory()
+	if err != nil {
+		panic(err)
+	}
+	if queueMode {
+		err = upgradeQueue()
+		if err != nil {
+			panic(err)
+		}
+	}
+	clientLog := newLogger("Client")
+	err = loadSessions(container, sessionsSpec, clientLog)
 	if err != nil {
 		panic(err)
 	}
-	clientLog := waLog.Stdout("Client", "INFO", true)
-	client := whatsmeow.NewClient(deviceStore, clientLog)
 
 	server := &http.Server{
-		Addr: httpServe,
+		Addr:              httpServe,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
 	}
+	server.RegisterOnShutdown(func() {
+		close(shuttingDown)
+	})
 
 	onClose := make(chan bool)
 
-	go startHttpServer(server, client, onClose)
+	go startHttpServer(server, onClose)
+	go expireStatuses()
 
-	var handler func(evt interface{})
-	handler = func(evt interface{}) {
-		switch v := evt.(type) {
-		case *events.StreamError:
+	for _, s := range allSessions() {
+		s.shutdown = func() {
 			_ = server.Close()
-		case *events.QR:
-			readyState.lock.Lock()
-			readyState.qrCode = v.Codes[0]
-			readyState.lock.Unlock()
-		case *events.PairSuccess:
-			readyState.lock.Lock()
-			readyState.ready = true
-			readyState.lock.Unlock()
-		case *events.LoggedOut:
-			readyState.lock.Lock()
-			readyState.ready = false
-			readyState.qrCode = ""
-			readyState.lock.Unlock()
-			go func() {
-				time.Sleep(5 * time.Second)
-				client = whatsmeow.NewClient(deviceStore, clientLog)
-				client.AddEventHandler(handler)
-				err = client.Connect()
-				if err != nil {
-					_, _ = fmt.Fprintf(os.Stderr, "Error reconnecting: %s\n", err)
-					_ = server.Shutdown(context.Background())
-				}
-			}()
-		}
-	}
-
-	client.AddEventHandler(handler)
-
-	err = client.Connect()
-	if err != nil {
-		panic(err)
+		}
+		err = s.connect()
+		if err != nil {
+			panic(err)
+		}
+		if queueMode {
+			go s.runQueue()
+		}
+		go s.runSchedule()
+		go s.runBatches()
 	}
-
-	if client.Store.ID != nil {
-		readyState.lock.Lock()
-		readyState.ready = true
-		readyState.lock.Unlock()
+	if queueURL != "" {
+		brokerCtx, stopBroker := context.WithCancel(context.Background())
+		server.RegisterOnShutdown(stopBroker)
+		go runBroker(brokerCtx)
 	}
 
 	// Listen to Ctrl+C (you can also do something else that prevents the program from exiting)
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadSettings(); err != nil {
+				mainLog.Errorf("Error reloading settings, keeping the current ones: %s", err)
+				continue
+			}
+			mainLog.Infof("Reloaded the key, API keys, templates and rate limits")
+		}
+	}()
+
 	select {
 	case <-c:
 	case <-onClose:
 	}
 
-	client.Disconnect()
-	_ = server.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// stop accepting requests first, then let the pending sends finish
+	_ = server.Shutdown(ctx)
+	drained := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		mainLog.Warnf("Timed out waiting for in-flight sends")
+	}
 
-	time.Sleep(1 * time.Second)
+	for _, s := range allSessions() {
+		s.Client().Disconnect()
+	}
 }
 
-func startHttpServer(server *http.Server, wa *whatsmeow.Client, onClose chan<- bool) {
+// waitForDB pings the database until it answers, with the delay between the
+// attempts doubling up to ten seconds, and gives up with the last error once
+// wait has passed.
+func waitForDB(db *sql.DB, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("database not reachable after %d attempts: %w", attempt, err)
+		}
+		mainLog.Warnf("Database not reachable (attempt %d), retrying in %s: %s", attempt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
+	}
+}
+
+func startHttpServer(server *http.Server, onClose chan<- bool) {
+	routers := make(map[string]http.Handler)
+	all := allSessions()
+	for _, s := range all {
+		routers[s.name] = newRouter(s)
+	}
+	// the first session also serves the paths without a /s/{session} prefix
+	handler := limitBody(maxBody, routeSessions(routers, routers[all[0].name]))
+	if corsOrigins != "" {
+		handler = cors(splitList(corsOrigins), handler)
+	}
+	server.Handler = accessLog(newLogger("HTTP"), handler)
+	var err error
+	switch {
+	case tlsAuto != "":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(tlsAuto),
+			Cache:      autocert.DirCache(tlsCache),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		err = server.ListenAndServeTLS("", "")
+	case tlsCert != "" && tlsKey != "":
+		err = server.ListenAndServeTLS(tlsCert, tlsKey)
+	default:
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		mainLog.Errorf("Error starting HTTP server: %s", err)
+	}
+	onClose <- true
+}
+
+// newRouter serves the endpoints on behalf of the session s.
+func newRouter(s *session) http.Handler {
 	router := http.NewServeMux()
-	router.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		readyState.lock.RLock()
-		ready := readyState.ready
-		readyState.lock.RUnlock()
-		if ready {
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("OK"))
-		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			_, _ = w.Write([]byte("not ready"))
+	router.HandleFunc("/ready", handleReady(s))
+	router.HandleFunc("/healthz", handleHealthz)
+	router.HandleFunc("/version", handleVersion)
+	router.HandleFunc("/readyz", handleReadyz(s))
+	router.HandleFunc("/send", trackInFlight(idempotent(s, handleSend(s))))
+	router.HandleFunc("/send/image", trackInFlight(idempotent(s, handleSendImage(s))))
+	router.HandleFunc("/send/document", trackInFlight(idempotent(s, handleSendDocument(s))))
+	router.HandleFunc("/send/audio", trackInFlight(idempotent(s, handleSendAudio(s))))
+	router.HandleFunc("/send/video", trackInFlight(idempotent(s, handleSendVideo(s))))
+	router.HandleFunc("/send/sticker", trackInFlight(idempotent(s, handleSendSticker(s))))
+	router.HandleFunc("/send/location", trackInFlight(idempotent(s, handleSendLocation(s))))
+	router.HandleFunc("/send/contact", trackInFlight(idempotent(s, handleSendContact(s))))
+	router.HandleFunc("/send/poll", trackInFlight(idempotent(s, handleSendPoll(s))))
+	router.HandleFunc("/send/buttons", trackInFlight(idempotent(s, handleSendButtons(s))))
+	router.HandleFunc("/send/list", trackInFlight(idempotent(s, handleSendList(s))))
+	router.HandleFunc("/send/status", trackInFlight(idempotent(s, handleSendStatus(s))))
+	router.HandleFunc("/send/batch", trackInFlight(idempotent(s, handleSendBatch(s))))
+	router.HandleFunc("/send/template", trackInFlight(idempotent(s, handleSendTemplate(s))))
+	router.HandleFunc("/send/batch/", handleBatchJob(s))
+	if allowRaw {
+		router.HandleFunc("/send/raw", trackInFlight(idempotent(s, handleSendRaw(s))))
+	}
+	router.HandleFunc("/edit", trackInFlight(handleEdit(s)))
+	router.HandleFunc("/react", trackInFlight(handleReact(s)))
+	router.HandleFunc("/revoke", trackInFlight(handleRevoke(s)))
+	router.HandleFunc("/read", handleRead(s))
+	router.HandleFunc("/chat", handleChat(s))
+	router.HandleFunc("/presence", handlePresence(s))
+	router.HandleFunc("/presence/subscribe", handlePresenceSubscribe(s, true))
+	router.HandleFunc("/presence/unsubscribe", handlePresenceSubscribe(s, false))
+	router.HandleFunc("/chatpresence", handleChatPresence(s))
+	router.HandleFunc("/lastseen", handleLastSeen(s))
+	router.HandleFunc("/block", handleBlock(s, true))
+	router.HandleFunc("/unblock", handleBlock(s, false))
+	router.HandleFunc("/blocklist", handleBlocklist(s))
+	router.HandleFunc("/logout", handleLogout(s))
+	router.HandleFunc("/pair", handlePair(s))
+	router.HandleFunc("/session/export", handleSessionExport(s))
+	router.HandleFunc("/session/import", handleSessionImport(s))
+	router.HandleFunc("/status", handleStatus(s))
+	router.HandleFunc("/history", handleHistory(s))
+	router.HandleFunc("/ws", handleEvents(s))
+	router.HandleFunc("/events", handleEventStream(s))
+	router.HandleFunc("/schedule/", handleSchedule(s))
+	router.HandleFunc("/groups", handleGroups(s))
+	router.HandleFunc("/groups/create", handleCreateGroup(s))
+	router.HandleFunc("/groups/join", handleJoinGroup(s))
+	router.HandleFunc("/groups/", handleGroup(s))
+	router.HandleFunc("/contacts", handleContacts(s))
+	router.HandleFunc("/profile", handleProfile(s))
+	router.HandleFunc("/avatar", handleAvatar(s))
+	router.HandleFunc("/media/download", handleMediaDownload(s))
+	router.HandleFunc("/check", handleCheck(s))
+	router.HandleFunc("/metrics", handleMetrics(s))
+	router.HandleFunc("/qr", handleQR(s))
+	router.HandleFunc("/qr/wait", handleQRWait(s))
+	router.HandleFunc("/qr/next", handleQRNext(s))
+	return router
+}
+
+// handleReady reports the connection state of the session, answering 200
+// only once it is logged in.
+func handleReady(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := map[string]interface{}{
+			"connected": false,
+			"loggedIn":  sess.isReady(),
+			"jid":       "",
+			"pushName":  "",
 		}
-	})
-	router.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
-		readyState.lock.RLock()
-		ready := readyState.ready
-		readyState.lock.RUnlock()
-		if !ready {
+		if cli := sess.Client(); cli != nil {
+			state["connected"] = cli.IsConnected()
+			if cli.Store.ID != nil {
+				state["jid"] = cli.Store.ID.String()
+			} else {
+				// waiting for a QR scan or a pairing code
+				state["pairing"] = true
+			}
+			state["pushName"] = cli.Store.PushName
+		}
+		sess.lock.RLock()
+		if sess.missingDevice != "" {
+			state["missingDevice"] = sess.missingDevice
+		}
+		sess.lock.RUnlock()
+		status := http.StatusOK
+		if !sess.isReady() {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, state)
+	}
+}
+
+// handleHealthz is the liveness probe, it answers as long as the HTTP server
+// is up and never looks at the WhatsApp client, which may be waiting for a
+// QR scan for a long time.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+// handleReadyz is the readiness probe, answering 200 only while the session
+// is both paired and connected.
+func handleReadyz(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cli := sess.Client()
+		if !sess.isReady() || cli == nil || !cli.IsConnected() {
 			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready"))
 			return
 		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	}
+}
+
+func handleLogout(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		_ = r.ParseForm()
-		key := r.Form.Get("key")
-		if !safeEql(key, serverKey) {
+		if authorize(sess, r, r.Form.Get("key")) == nil {
 			w.WriteHeader(http.StatusForbidden)
 			_, _ = w.Write([]byte("403 Forbidden"))
 			return
 		}
-		to := r.Form.Get("to")
-		if to == "" {
+		if !sess.state.BeginLogout() {
 			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("to is required"))
+			_, _ = w.Write([]byte("not logged in"))
 			return
 		}
-		jid, err := types.ParseJID(to)
+		defer sess.state.EndLogout()
+		err := sess.Client().Logout()
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(http.StatusInternalServerError)
 			_, _ = w.Write([]byte(err.Error()))
 			return
 		}
-		text := r.Form.Get("text")
-		if text == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("text is required"))
-			return
-		}
-		msg := &proto.Message{
-			Conversation: &text,
-		}
-		_, err = wa.SendMessage(context.Background(), jid, msg)
+		sess.setReady(false)
+		// start over with a fresh client so a new QR code becomes available
+		err = sess.connect()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(err.Error()))
+			_, _ = w.Write([]byte(fmt.Sprintf("logged out but failed to reconnect: %s", err)))
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
-	})
-	router.HandleFunc("/qr", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		if !safeEql(key, serverKey) {
+	}
+}
+
+// handlePair requests a pairing code for linking with a phone number as an
+// alternative to scanning the QR code.
+func handlePair(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
 			w.WriteHeader(http.StatusForbidden)
 			_, _ = w.Write([]byte("403 Forbidden"))
 			return
 		}
-		readyState.lock.RLock()
-		qrCode := readyState.qrCode
-		ready := readyState.ready
-		readyState.lock.RUnlock()
-		if ready {
+		phone := r.Form.Get("phone")
+		if phone == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("phone is required"))
+			return
+		}
+		state := sess.state.Snapshot()
+		code := ""
+		if state.PairPhone == phone {
+			code = state.PairCode
+		}
+		if state.Ready {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("already logged in"))
 			return
 		}
-		if qrCode == "" {
+		// the first QR event tells the login websocket is up and accepts pairing
+		if state.QRCode == "" {
 			w.WriteHeader(http.StatusServiceUnavailable)
-			_, _ = w.Write([]byte("no QR code available"))
+			_, _ = w.Write([]byte("not ready for pairing"))
 			return
 		}
-		w.Header().Set("Content-Type", "image/png")
-		png, err := qrcode.Encode(qrCode, qrcode.Medium, 256)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(err.Error()))
-			return
+		if code == "" {
+			clientType, displayName := pairClient()
+			var err error
+			code, err = sess.Client().PairPhone(phone, true, clientType, displayName)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			sess.state.SetPairing(phone, code)
 		}
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(png)))
-		w.Header().Set("Content-Type", "image/png")
-		_, _ = w.Write(png)
-	})
-	server.Handler = router
-	err := server.ListenAndServe()
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Error starting HTTP server: %s\n", err)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"code": code,
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// trackInFlight registers the requests handled by h in inFlight.
+func trackInFlight(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		h(w, r)
 	}
-	onClose <- true
 }
 
 func safeEql(a string, b string) bool {
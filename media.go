@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// maxDocumentSize is the largest document WhatsApp accepts.
+const maxDocumentSize = 100 << 20
+
+// readMedia returns the media bytes of a request, taken from the multipart
+// file part named field or, failing that, from the base64 encoded value.
+// The file name is only known for multipart uploads.
+func readMedia(r *http.Request, field string, encoded string) ([]byte, string, error) {
+	if r.MultipartForm != nil {
+		file, header, err := r.FormFile(field)
+		if err == nil {
+			defer file.Close()
+			data, err := io.ReadAll(file)
+			return data, header.Filename, err
+		}
+		if err != http.ErrMissingFile {
+			return nil, "", err
+		}
+	}
+	if encoded == "" {
+		return nil, "", fmt.Errorf("%s is required", field)
+	}
+	// accept data URIs such as "data:image/png;base64,..."
+	if strings.HasPrefix(encoded, "data:") {
+		if i := strings.Index(encoded, ","); i >= 0 {
+			encoded = encoded[i+1:]
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid base64 %s: %s", field, err)
+	}
+	return data, "", nil
+}
+
+// uploadImage uploads an image and builds its message.
+func (s *session) uploadImage(ctx context.Context, data []byte, caption string) (*proto.ImageMessage, error) {
+	uploaded, err := s.upload(ctx, data, whatsmeow.MediaImage)
+	if err != nil {
+		return nil, err
+	}
+	image := &proto.ImageMessage{
+		Url:           gproto.String(uploaded.URL),
+		DirectPath:    gproto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      gproto.String(http.DetectContentType(data)),
+		FileEncSha256: uploaded.FileEncSHA256,
+		FileSha256:    uploaded.FileSHA256,
+		FileLength:    gproto.Uint64(uploaded.FileLength),
+	}
+	if caption != "" {
+		image.Caption = gproto.String(caption)
+	}
+	return image, nil
+}
+
+func handleSendImage(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		data, _, err := readMedia(r, "image", req.Image)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		ctx, cancel := sendContext(r.Context())
+		defer cancel()
+		image, err := sess.uploadImage(ctx, data, req.Caption)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		resp, attempts, err := sess.send(ctx, jid, &proto.Message{ImageMessage: image})
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		writeSendResponse(w, resp)
+	}
+}
+
+func handleSendDocument(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		data, fileName, err := readMedia(r, "document", req.Document)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if len(data) > maxDocumentSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = w.Write([]byte(fmt.Sprintf("document exceeds %d bytes", maxDocumentSize)))
+			return
+		}
+		if req.FileName != "" {
+			fileName = req.FileName
+		}
+		if fileName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("filename is required"))
+			return
+		}
+		mimetype := req.Mimetype
+		if mimetype == "" {
+			mimetype = mime.TypeByExtension(filepath.Ext(fileName))
+		}
+		if mimetype == "" {
+			mimetype = http.DetectContentType(data)
+		}
+		ctx, cancel := sendContext(r.Context())
+		defer cancel()
+		uploaded, err := sess.upload(ctx, data, whatsmeow.MediaDocument)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		document := &proto.DocumentMessage{
+			Url:           gproto.String(uploaded.URL),
+			DirectPath:    gproto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      gproto.String(mimetype),
+			FileName:      gproto.String(fileName),
+			Title:         gproto.String(fileName),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    gproto.Uint64(uploaded.FileLength),
+		}
+		msg := &proto.Message{DocumentMessage: document}
+		if req.Caption != "" {
+			// captions only show up when the document is wrapped
+			document.Caption = gproto.String(req.Caption)
+			msg = &proto.Message{DocumentWithCaptionMessage: &proto.FutureProofMessage{Message: msg}}
+		}
+		resp, attempts, err := sess.send(ctx, jid, msg)
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		writeSendResponse(w, resp)
+	}
+}
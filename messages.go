@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+func handleSendLocation(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		if req.Latitude == nil || req.Longitude == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("latitude and longitude are required"))
+			return
+		}
+		if *req.Latitude < -90 || *req.Latitude > 90 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("latitude must be between -90 and 90"))
+			return
+		}
+		if *req.Longitude < -180 || *req.Longitude > 180 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("longitude must be between -180 and 180"))
+			return
+		}
+		location := &proto.LocationMessage{
+			DegreesLatitude:  req.Latitude,
+			DegreesLongitude: req.Longitude,
+		}
+		if req.Name != "" {
+			location.Name = gproto.String(req.Name)
+		}
+		if req.Address != "" {
+			location.Address = gproto.String(req.Address)
+		}
+		deliver(w, r, sess, jid, &proto.Message{LocationMessage: location})
+	}
+}
+
+// messageSender returns the sender of a message being referred to, which
+// defaults to the chat itself for direct messages.
+func messageSender(chat types.JID, sender string) (types.JID, error) {
+	if sender == "" {
+		if chat.Server == types.GroupServer {
+			return types.JID{}, errors.New("the sender of the message is required in groups")
+		}
+		return chat, nil
+	}
+	return normalizeJID(sender)
+}
+
+// handleReact reacts to a message, an empty emoji removes the reaction.
+func handleReact(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, chat, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		if req.MessageID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("messageId is required"))
+			return
+		}
+		sender, err := messageSender(chat, req.Sender)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		deliver(w, r, sess, chat, sess.Client().BuildReaction(chat, sender, req.MessageID, req.Emoji))
+	}
+}
+
+// editWindow is how long after sending WhatsApp still accepts an edit.
+const editWindow = 15 * time.Minute
+
+// handleEdit replaces the text of a message sent by the service. Only the
+// messages it still tracks the status of are known, see -status-ttl, and
+// edits are never queued since they could miss the window.
+func handleEdit(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, chat, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		if req.MessageID == "" || req.Text == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("messageId and text are required"))
+			return
+		}
+		sent, ok := lookupSent(chat, req.MessageID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown message id"))
+			return
+		}
+		if time.Since(sent) > editWindow {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte("messages can only be edited within 15 minutes of sending"))
+			return
+		}
+		edit := sess.Client().BuildEdit(chat, req.MessageID, &proto.Message{Conversation: gproto.String(req.Text)})
+		resp, attempts, err := sess.send(r.Context(), chat, edit)
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		writeSendResponse(w, resp)
+	}
+}
+
+// handleRevoke deletes a message for everyone, or with forMe only from the
+// chats of the account. Sender is left out for own messages, group admins
+// can revoke the messages of others by giving it.
+func handleRevoke(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, chat, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		if req.MessageID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("messageId is required"))
+			return
+		}
+		sender := types.EmptyJID
+		if req.Sender != "" {
+			var err error
+			if sender, err = normalizeJID(req.Sender); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		cli := sess.Client()
+		if req.ForMe {
+			fromMe := sender.IsEmpty() || sender == cli.Store.ID.ToNonAD()
+			if err := cli.SendAppState(deleteForMe(chat, req.MessageID, fromMe)); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("OK"))
+			return
+		}
+		resp, attempts, err := sess.send(r.Context(), chat, cli.BuildRevoke(chat, sender, req.MessageID))
+		setAttempts(w, attempts)
+		switch {
+		case errors.Is(err, whatsmeow.ErrServerReturnedError):
+			// WhatsApp refuses to revoke messages past its time limit
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte("message can not be revoked: " + err.Error()))
+		case err != nil:
+			writeSendError(w, err)
+		default:
+			writeSendResponse(w, resp)
+		}
+	}
+}
+
+// deleteForMe builds the app state patch that removes a message from the
+// chats of the account only, whatsmeow has no builder for it.
+func deleteForMe(chat types.JID, id types.MessageID, fromMe bool) appstate.PatchInfo {
+	flag := "0"
+	if fromMe {
+		flag = "1"
+	}
+	var timestamp *int64
+	if sent, ok := lookupSent(chat, id); ok {
+		timestamp = gproto.Int64(sent.UnixMilli())
+	}
+	return appstate.PatchInfo{
+		Type: appstate.WAPatchRegularHigh,
+		Mutations: []appstate.MutationInfo{{
+			Index:   []string{appstate.IndexDeleteMessageForMe, chat.String(), id, flag, "0"},
+			Version: 3,
+			Value: &proto.SyncActionValue{
+				DeleteMessageForMeAction: &proto.DeleteMessageForMeAction{
+					DeleteMedia:      gproto.Bool(true),
+					MessageTimestamp: timestamp,
+				},
+			},
+		}},
+	}
+}
+
+// handleRead marks received messages as read, so their sender sees the blue
+// ticks.
+func handleRead(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		acl := authorize(sess, r, r.Form.Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("chat") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("chat is required"))
+			return
+		}
+		chat, err := normalizeJID(r.Form.Get("chat"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if !acl.allowsDestination(chat) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		sender, err := messageSender(chat, r.Form.Get("sender"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		var ids []types.MessageID
+		for _, value := range r.Form["messageIds"] {
+			ids = append(ids, splitList(value)...)
+		}
+		if len(ids) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("messageIds is required"))
+			return
+		}
+		err = sess.Client().MarkRead(ids, time.Now(), chat, sender)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	messagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "waservice_messages_sent_total",
+		Help: "Number of messages sent successfully.",
+	}, []string{"session"})
+	sendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "waservice_send_failures_total",
+		Help: "Number of messages which failed to send.",
+	}, []string{"session"})
+	qrRegenerations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "waservice_qr_regenerations_total",
+		Help: "Number of QR codes made available for pairing.",
+	}, []string{"session"})
+	reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "waservice_reconnects_total",
+		Help: "Number of reconnection attempts.",
+	}, []string{"session"})
+	connected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "waservice_connected",
+		Help: "Whether the session is connected to WhatsApp (1) or not (0).",
+	}, []string{"session"})
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(messagesSent, sendFailures, qrRegenerations, reconnects, connected)
+}
+
+// handleMetrics serves the Prometheus metrics, guarded by the server key
+// unless -metrics-no-auth is set for internal scraping.
+func handleMetrics(sess *session) http.HandlerFunc {
+	metrics := promhttp.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !metricsNoAuth && authorize(sess, r, r.URL.Query().Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	minPollOptions = 2
+	maxPollOptions = 12
+)
+
+func handleSendPoll(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		question := strings.TrimSpace(req.Question)
+		if question == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("question is required"))
+			return
+		}
+		options := make([]string, 0, len(req.Options))
+		seen := make(map[string]bool)
+		for _, option := range req.Options {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				continue
+			}
+			// votes refer to options by the hash of their text
+			if seen[option] {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(fmt.Sprintf("duplicated option %q", option)))
+				return
+			}
+			seen[option] = true
+			options = append(options, option)
+		}
+		if len(options) < minPollOptions || len(options) > maxPollOptions {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("a poll needs between %d and %d options", minPollOptions, maxPollOptions)))
+			return
+		}
+		if req.SelectableCount < 0 || req.SelectableCount > len(options) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("selectableCount must be between 0 and %d", len(options))))
+			return
+		}
+		deliver(w, r, sess, jid, sess.Client().BuildPollCreation(question, options, req.SelectableCount))
+	}
+}
+
+// upgradePolls creates the table keeping the options of known polls, votes
+// only carry the hashes of the options they are for.
+func upgradePolls() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS polls (
+		id         TEXT    PRIMARY KEY,
+		options    TEXT    NOT NULL,
+		created_at INTEGER NOT NULL
+	)`)
+	return err
+}
+
+// pollCreation returns the poll of msg, whichever version it is sent as.
+func pollCreation(msg *proto.Message) *proto.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	default:
+		return msg.GetPollCreationMessageV3()
+	}
+}
+
+// storePoll remembers the options of the poll with the given message id.
+func storePoll(id types.MessageID, poll *proto.PollCreationMessage) error {
+	options := make([]string, 0, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO polls (id, options, created_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING`, id, string(data), time.Now().Unix())
+	return err
+}
+
+// pollOptions returns the options of a stored poll by their hashes.
+func pollOptions(id string) (map[string]string, error) {
+	var data string
+	err := db.QueryRow(`SELECT options FROM polls WHERE id=$1`, id).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	var options []string
+	if err = json.Unmarshal([]byte(data), &options); err != nil {
+		return nil, err
+	}
+	byHash := make(map[string]string, len(options))
+	for i, hash := range whatsmeow.HashPollOptions(options) {
+		byHash[string(hash)] = options[i]
+	}
+	return byHash, nil
+}
+
+// pollVotePayload is posted to -webhook for every vote on a known poll,
+// Options holds all the options the voter currently selects.
+type pollVotePayload struct {
+	Type      string   `json:"type"`
+	Session   string   `json:"session"`
+	PollID    string   `json:"pollId"`
+	Chat      string   `json:"chat"`
+	Voter     string   `json:"voter"`
+	Timestamp int64    `json:"timestamp"`
+	Options   []string `json:"options"`
+}
+
+// forwardPollVote decrypts a poll vote and posts it to the webhook.
+func (s *session) forwardPollVote(evt *events.Message) {
+	vote, err := s.Client().DecryptPollVote(evt)
+	if err != nil {
+		s.log.Warnf("Error decrypting poll vote %s: %s", evt.Info.ID, err)
+		return
+	}
+	pollID := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetId()
+	byHash, err := pollOptions(pollID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.log.Debugf("Ignoring vote %s on unknown poll %s", evt.Info.ID, pollID)
+		return
+	} else if err != nil {
+		mainLog.Errorf("Error loading poll %s: %s", pollID, err)
+		return
+	}
+	options := make([]string, 0, len(vote.GetSelectedOptions()))
+	for _, hash := range vote.GetSelectedOptions() {
+		if option, ok := byHash[string(hash)]; ok {
+			options = append(options, option)
+		}
+	}
+	postWebhook(webhook, &pollVotePayload{
+		Type:      "poll_vote",
+		Session:   s.name,
+		PollID:    pollID,
+		Chat:      evt.Info.Chat.String(),
+		Voter:     evt.Info.Sender.ToNonAD().String(),
+		Timestamp: evt.Info.Timestamp.Unix(),
+		Options:   options,
+	})
+}
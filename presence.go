@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// setPresence announces the presence of the session, remembering it so chat
+// presences can tell whether the session has been marked available.
+func (s *session) setPresence(presence types.Presence) error {
+	err := s.Client().SendPresence(presence)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.presence = presence
+	s.lock.Unlock()
+	return nil
+}
+
+// presenceError answers a failed presence update, presences can only be sent
+// on a connection and once the push name is known.
+func presenceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, whatsmeow.ErrNotConnected) || errors.Is(err, whatsmeow.ErrNoPushName) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_, _ = w.Write([]byte(err.Error()))
+}
+
+// handlePresence marks the session as available or unavailable.
+func handlePresence(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		presence := types.Presence(r.Form.Get("presence"))
+		if presence != types.PresenceAvailable && presence != types.PresenceUnavailable {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("presence must be available or unavailable"))
+			return
+		}
+		if err := sess.setPresence(presence); err != nil {
+			presenceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	}
+}
+
+// handleChatPresence shows or clears the typing indicator in a chat, with
+// media=audio it shows a voice note being recorded instead. WhatsApp only
+// relays chat presences of available accounts, so the session is marked
+// available first unless that has been done already.
+func handleChatPresence(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		acl := authorize(sess, r, r.Form.Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("to") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("to is required"))
+			return
+		}
+		jid, err := normalizeJID(r.Form.Get("to"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if !acl.allowsDestination(jid) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		state := types.ChatPresence(r.Form.Get("state"))
+		if state != types.ChatPresenceComposing && state != types.ChatPresencePaused {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("state must be composing or paused"))
+			return
+		}
+		media := types.ChatPresenceMedia(r.Form.Get("media"))
+		if media != types.ChatPresenceMediaText && media != types.ChatPresenceMediaAudio {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("media must be empty or audio"))
+			return
+		}
+		if err = sess.ensureAvailable(); err != nil {
+			presenceError(w, err)
+			return
+		}
+		if err = sess.Client().SendChatPresence(jid, state, media); err != nil {
+			presenceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	}
+}
+
+// ensureAvailable marks the session available unless it is already, WhatsApp
+// only relays presences to and from available accounts.
+func (s *session) ensureAvailable() error {
+	s.lock.RLock()
+	available := s.presence == types.PresenceAvailable
+	s.lock.RUnlock()
+	if available {
+		return nil
+	}
+	return s.setPresence(types.PresenceAvailable)
+}
+
+// resubscribePresences renews the presence subscriptions on a new
+// connection, WhatsApp forgets them along with the old one.
+func (s *session) resubscribePresences() {
+	s.lock.RLock()
+	jids := make([]types.JID, 0, len(s.subscriptions))
+	for jid := range s.subscriptions {
+		jids = append(jids, jid)
+	}
+	s.lock.RUnlock()
+	if len(jids) == 0 {
+		return
+	}
+	if err := s.ensureAvailable(); err != nil {
+		s.log.Warnf("Error marking session available for presence subscriptions: %s", err)
+		return
+	}
+	for _, jid := range jids {
+		if err := s.Client().SubscribePresence(jid); err != nil {
+			s.log.Warnf("Error subscribing to the presence of %s: %s", jid, err)
+		}
+	}
+}
+
+// presencePayload is posted to the webhook when a subscribed contact comes
+// online or goes offline, LastSeen is only known for the latter.
+type presencePayload struct {
+	Type      string `json:"type"`
+	Session   string `json:"session"`
+	JID       string `json:"jid"`
+	Available bool   `json:"available"`
+	LastSeen  int64  `json:"lastSeen,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (s *session) forwardPresence(evt *events.Presence) {
+	payload := &presencePayload{
+		Type:      "presence",
+		Session:   s.name,
+		JID:       evt.From.ToNonAD().String(),
+		Available: !evt.Unavailable,
+		Timestamp: time.Now().Unix(),
+	}
+	if !evt.LastSeen.IsZero() {
+		payload.LastSeen = evt.LastSeen.Unix()
+	}
+	postWebhook(webhook, payload)
+}
+
+// handlePresenceSubscribe subscribes to the presence of a contact, or with
+// the unsubscribe path stops it. Changes are posted to the webhook. GET lists
+// the current subscriptions.
+func handlePresenceSubscribe(sess *session, subscribe bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		acl := authorize(sess, r, r.Form.Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if r.Method == http.MethodGet {
+			sess.lock.RLock()
+			jids := make([]string, 0, len(sess.subscriptions))
+			for jid := range sess.subscriptions {
+				jids = append(jids, jid.String())
+			}
+			sess.lock.RUnlock()
+			sort.Strings(jids)
+			writeJSON(w, http.StatusOK, jids)
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("jid") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("jid is required"))
+			return
+		}
+		jid, err := normalizeJID(r.Form.Get("jid"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if jid.Server != types.DefaultUserServer {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("only the presence of users can be subscribed to"))
+			return
+		}
+		if !acl.allowsDestination(jid) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		if subscribe {
+			if err = sess.ensureAvailable(); err == nil {
+				err = sess.Client().SubscribePresence(jid)
+			}
+		} else {
+			err = sess.unsubscribePresence(jid)
+		}
+		if err != nil {
+			presenceError(w, err)
+			return
+		}
+		sess.lock.Lock()
+		if subscribe {
+			sess.subscriptions[jid] = true
+		} else {
+			delete(sess.subscriptions, jid)
+		}
+		sess.lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	}
+}
+
+// unsubscribePresence stops the presence updates of jid, whatsmeow has no
+// counterpart to SubscribePresence.
+func (s *session) unsubscribePresence(jid types.JID) error {
+	return s.Client().DangerousInternals().SendNode(waBinary.Node{
+		Tag:   "presence",
+		Attrs: waBinary.Attrs{"type": "unsubscribe", "to": jid},
+	})
+}
+
+// awaitPresence registers for the next presence of jid, the returned
+// function must be called once done waiting.
+func (s *session) awaitPresence(jid types.JID) (<-chan *events.Presence, func()) {
+	ch := make(chan *events.Presence, 1)
+	s.lock.Lock()
+	s.presenceWaiters[jid] = append(s.presenceWaiters[jid], ch)
+	s.lock.Unlock()
+	return ch, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		waiters := s.presenceWaiters[jid]
+		for i, waiter := range waiters {
+			if waiter == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(s.presenceWaiters, jid)
+		} else {
+			s.presenceWaiters[jid] = waiters
+		}
+	}
+}
+
+func (s *session) wakePresenceWaiters(evt *events.Presence) {
+	jid := evt.From.ToNonAD()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, ch := range s.presenceWaiters[jid] {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+// handleLastSeen subscribes to the presence of a contact and answers with
+// the first update, WhatsApp sends one right after subscribing. The wait
+// defaults to 5s and is capped at 30s, 204 means WhatsApp revealed nothing
+// in time, which is what the privacy settings of the contact may cause.
+func handleLastSeen(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		acl := authorize(sess, r, r.Form.Get("key"))
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("jid") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("jid is required"))
+			return
+		}
+		jid, err := normalizeJID(r.Form.Get("jid"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if jid.Server != types.DefaultUserServer {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("only the presence of users can be queried"))
+			return
+		}
+		if !acl.allowsDestination(jid) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		timeout := 5 * time.Second
+		if v := r.Form.Get("timeout"); v != "" {
+			timeout, err = time.ParseDuration(v)
+			if err != nil || timeout <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid timeout"))
+				return
+			}
+			if timeout > 30*time.Second {
+				timeout = 30 * time.Second
+			}
+		}
+		updates, done := sess.awaitPresence(jid)
+		subscribed := false
+		defer func() {
+			done()
+			if !subscribed {
+				return
+			}
+			// a /presence/subscribe or another /lastseen may have come in
+			// while waiting, the subscription is theirs then
+			sess.lock.RLock()
+			inUse := sess.subscriptions[jid] || len(sess.presenceWaiters[jid]) > 0
+			sess.lock.RUnlock()
+			if inUse {
+				return
+			}
+			if err := sess.unsubscribePresence(jid); err != nil {
+				sess.log.Warnf("Error unsubscribing from the presence of %s: %s", jid, err)
+			}
+		}()
+		if err = sess.ensureAvailable(); err == nil {
+			err = sess.Client().SubscribePresence(jid)
+		}
+		if err != nil {
+			presenceError(w, err)
+			return
+		}
+		subscribed = true
+		var evt *events.Presence
+		select {
+		case evt = <-updates:
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+		// an offline contact without last seen hides it
+		if evt == nil || (evt.Unavailable && evt.LastSeen.IsZero()) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		result := map[string]interface{}{
+			"jid":       jid.String(),
+			"available": !evt.Unavailable,
+		}
+		if !evt.LastSeen.IsZero() {
+			result["lastSeen"] = evt.LastSeen.Unix()
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	previewTimeout = 5 * time.Second
+	// previewThumbnailSize is the longest side of preview thumbnails.
+	previewThumbnailSize = 192
+	maxPreviewPage       = 1 << 20
+	maxPreviewImage      = 5 << 20
+	// maxPreviewPixels bounds the decoded size of preview images, a small
+	// file can claim huge dimensions.
+	maxPreviewPixels = 4096 * 4096
+)
+
+var previewURL = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// previewClient only reaches public addresses, the links come from the
+// message text and must not be able to probe the network of the service.
+// Checking the address at dial time covers redirects and DNS rebinding.
+var previewClient = &http.Client{
+	Timeout: previewTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: previewTimeout,
+			Control: publicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout: previewTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkPreviewScheme(req.URL)
+	},
+}
+
+// publicOnly refuses connections to loopback, private, link-local and other
+// non-public addresses.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		cgnat.Contains(addr) {
+		return fmt.Errorf("address %s is not public", addr)
+	}
+	return nil
+}
+
+// cgnat is the shared address space of carrier-grade NAT, which IsPrivate
+// does not include.
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+func checkPreviewScheme(link *url.URL) error {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", link.Scheme)
+	}
+	return nil
+}
+
+// linkPreview is the OpenGraph metadata of the first link in a text.
+type linkPreview struct {
+	matchedText string
+	url         string
+	title       string
+	description string
+	thumbnail   []byte
+}
+
+// fetchPreview builds the preview of the first link in text, it fails if
+// there is no link or the page has no title.
+func fetchPreview(text string) (*linkPreview, error) {
+	link := previewURL.FindString(text)
+	if link == "" {
+		return nil, errors.New("no link in text")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+	page, err := fetchLimited(ctx, link, maxPreviewPage)
+	if err != nil {
+		return nil, err
+	}
+	if contentType, _, _ := mime.ParseMediaType(page.contentType); contentType != "text/html" {
+		return nil, fmt.Errorf("unexpected content type %q", page.contentType)
+	}
+	preview := &linkPreview{matchedText: link, url: page.url}
+	imageRef := parseOpenGraph(page.body, preview)
+	if preview.title == "" {
+		return nil, errors.New("page has no title")
+	}
+	if imageRef != "" {
+		if imageURL, err := url.Parse(page.url); err == nil {
+			if imageURL, err = imageURL.Parse(imageRef); err == nil {
+				// a preview without a picture is still better than none
+				preview.thumbnail, _ = fetchThumbnail(ctx, imageURL.String())
+			}
+		}
+	}
+	return preview, nil
+}
+
+type fetched struct {
+	url         string
+	contentType string
+	body        []byte
+}
+
+// fetchLimited gets url, reading at most limit bytes of the body. Pages are
+// requested as WhatsApp does, which some sites only serve their OpenGraph
+// tags to.
+func fetchLimited(ctx context.Context, link string, limit int64) (*fetched, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPreviewScheme(req.URL); err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "WhatsApp/2.23.20.0")
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, err
+	}
+	return &fetched{
+		url:         resp.Request.URL.String(),
+		contentType: resp.Header.Get("Content-Type"),
+		body:        body,
+	}, nil
+}
+
+// parseOpenGraph fills in the title and description of preview from the
+// head of the page, falling back to the plain HTML tags, and returns the
+// og:image reference.
+func parseOpenGraph(page []byte, preview *linkPreview) string {
+	var title, description, imageRef string
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	inTitle := false
+tokens:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			break tokens
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "body":
+				// the metadata is all in the head
+				break tokens
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				switch key {
+				case "og:title":
+					preview.title = content
+				case "og:description":
+					preview.description = content
+				case "og:image":
+					imageRef = content
+				case "og:url":
+					if content != "" {
+						preview.url = content
+					}
+				case "description":
+					description = content
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			if tokenizer.Token().Data == "title" {
+				inTitle = false
+			}
+		}
+	}
+	if preview.title == "" {
+		preview.title = strings.TrimSpace(title)
+	}
+	if preview.description == "" {
+		preview.description = description
+	}
+	return imageRef
+}
+
+// fetchThumbnail downloads an image and scales it down to a JPEG thumbnail.
+func fetchThumbnail(ctx context.Context, link string) ([]byte, error) {
+	img, err := fetchLimited(ctx, link, maxPreviewImage)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.body))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxPreviewPixels {
+		return nil, fmt.Errorf("image of %dx%d is too large", config.Width, config.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(img.body))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = jpeg.Encode(&out, scaleDown(decoded, previewThumbnailSize), &jpeg.Options{Quality: 70})
+	return out.Bytes(), err
+}
+
+// scaleDown shrinks img with nearest-neighbour sampling so that its longest
+// side is at most size, smaller images are returned as they are.
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size || bounds.Empty() {
+		return img
+	}
+	newWidth, newHeight := size, height*size/width
+	if height > width {
+		newWidth, newHeight = width*size/height, size
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			scaled.Set(x, y, img.At(bounds.Min.X+x*width/newWidth, bounds.Min.Y+y*height/newHeight))
+		}
+	}
+	return scaled
+}
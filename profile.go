@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// handleProfile shows the profile of the logged in account, or the one of
+// another user given by jid, and updates the push name and status text of
+// the account on PUT or POST.
+func handleProfile(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			showProfile(w, r, sess)
+		case http.MethodPut, http.MethodPost:
+			updateProfile(w, r, sess)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func showProfile(w http.ResponseWriter, r *http.Request, sess *session) {
+	cli := sess.Client()
+	jid := cli.Store.ID.ToNonAD()
+	own := true
+	if value := r.Form.Get("jid"); value != "" {
+		var err error
+		jid, err = normalizeJID(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		own = jid == cli.Store.ID.ToNonAD()
+	}
+	profile := map[string]interface{}{
+		"jid": jid.String(),
+	}
+	if own {
+		profile["pushName"] = cli.Store.PushName
+	}
+	if jid.Server == types.DefaultUserServer {
+		info, err := cli.GetUserInfo([]types.JID{jid})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		profile["status"] = info[jid].Status
+	}
+	picture, err := cli.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{})
+	switch {
+	case errors.Is(err, whatsmeow.ErrProfilePictureNotSet), errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized):
+		// hidden or missing pictures are reported as none
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	case picture != nil:
+		profile["pictureUrl"] = picture.URL
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// updateProfile sets the push name and status text given as name and
+// status, fields left out stay unchanged.
+func updateProfile(w http.ResponseWriter, r *http.Request, sess *session) {
+	cli := sess.Client()
+	_, hasName := r.Form["name"]
+	_, hasStatus := r.Form["status"]
+	if !hasName && !hasStatus {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("name or status is required"))
+		return
+	}
+	if hasName {
+		name := r.Form.Get("name")
+		if name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("name can not be empty"))
+			return
+		}
+		// the push name is an app state setting, applying the patch also
+		// updates the name in the device store
+		if err := cli.SendAppState(appstate.BuildSettingPushName(name)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if hasStatus {
+		if err := cli.SetStatusMessage(r.Form.Get("status")); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+// maxAvatarSize bounds the profile pictures /avatar passes through.
+const maxAvatarSize = 5 << 20
+
+// handleAvatar serves the profile picture of a user or group, the small
+// thumbnail with preview=true. It proxies the image unless redirect=true
+// asks for a redirect to WhatsApp's URL, which expires after a while.
+func handleAvatar(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("jid") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("jid is required"))
+			return
+		}
+		jid, err := normalizeJID(r.Form.Get("jid"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		preview, err := formBool(r, "preview")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		redirect, err := formBool(r, "redirect")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		picture, err := sess.Client().GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{Preview: preview})
+		switch {
+		case errors.Is(err, whatsmeow.ErrProfilePictureNotSet), errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized):
+			// hidden pictures look the same as missing ones to the caller
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		case picture == nil:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("no profile picture"))
+			return
+		}
+		if redirect {
+			http.Redirect(w, r, picture.URL, http.StatusFound)
+			return
+		}
+		avatar, err := fetchLimited(r.Context(), picture.URL, maxAvatarSize)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		contentType := avatar.contentType
+		if contentType == "" {
+			contentType = http.DetectContentType(avatar.body)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, max-age=300")
+		w.Header().Set("ETag", `"`+picture.ID+`"`)
+		_, _ = w.Write(avatar.body)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// rotateQR cycles through the codes of a QR event as they expire, following
+// whatsmeow's timing: 60 seconds for the first code of a fresh login and 20
+// seconds for every other one. WhatsApp drops the login once the last code
+// runs out, -qr-expiry decides whether a fresh one is requested right away.
+// /qr/next moves on to the next code early.
+func (s *session) rotateQR(codes []string) {
+	generation, advance := s.state.NewQRGeneration(len(codes))
+	for i, code := range codes {
+		timeout := 20 * time.Second
+		if i == 0 && len(codes) == 6 {
+			timeout = 60 * time.Second
+		}
+		if !s.state.SetQR(generation, i, code, time.Now().Add(timeout)) {
+			return
+		}
+		qrRegenerations.WithLabelValues(s.name).Inc()
+		s.events.publish(s.statePayload())
+		if qrStdout {
+			s.printQR(code)
+		}
+		expiry := time.NewTimer(timeout)
+		select {
+		case <-expiry.C:
+		case <-advance:
+			expiry.Stop()
+		}
+	}
+	if !s.state.ExpireQR(generation, qrExpiry == "expire") {
+		return
+	}
+	s.notifyLifecycle("qr_expired")
+	if qrExpiry == "renew" {
+		s.renewQR()
+	}
+}
+
+// renewQR starts the login over with a fresh client, which brings a new set
+// of QR codes.
+func (s *session) renewQR() {
+	s.log.Infof("QR codes of session %s expired, requesting new ones", s.name)
+	s.Client().Disconnect()
+	if err := s.connect(); err != nil {
+		s.log.Errorf("Error requesting new QR codes: %s", err)
+	}
+}
+
+// qrPNGCache holds the PNG of the last QR code rendered, polling clients
+// keep asking for the same code until it rotates. The lock is held while
+// encoding so concurrent requests wait for the one doing it.
+var qrPNGCache = struct {
+	lock sync.Mutex
+	code string
+	png  []byte
+}{}
+
+// qrPNG renders the QR code content as a PNG, reusing the previous
+// rendering when the code has not changed. Only a miss encodes the code.
+func qrPNG(content string) ([]byte, error) {
+	qrPNGCache.lock.Lock()
+	defer qrPNGCache.lock.Unlock()
+	if qrPNGCache.code == content && qrPNGCache.png != nil {
+		return qrPNGCache.png, nil
+	}
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	png, err := code.PNG(256)
+	if err != nil {
+		return nil, err
+	}
+	qrPNGCache.code, qrPNGCache.png = content, png
+	return png, nil
+}
+
+// qrFormat picks the /qr output format from the format query parameter,
+// falling back to the Accept header and then to PNG.
+func qrFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "image/svg+xml"):
+		return "svg"
+	case strings.Contains(accept, "text/plain"):
+		return "text"
+	}
+	return "png"
+}
+
+// qrSVG renders the QR code as an SVG image, one square per module.
+func qrSVG(code *qrcode.QRCode) []byte {
+	bitmap := code.Bitmap()
+	size := len(bitmap)
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	_, _ = fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				_, _ = fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// qrASCII renders the QR code for a terminal with Unicode half blocks, two
+// rows of modules per line. Light modules are drawn since terminals are
+// mostly dark, invert draws the dark ones for light terminals instead.
+func qrASCII(code *qrcode.QRCode, invert bool) []byte {
+	bitmap := code.Bitmap()
+	var buf bytes.Buffer
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			top := bitmap[y][x] == invert
+			bottom := y+1 < len(bitmap) && bitmap[y+1][x] == invert
+			if y+1 == len(bitmap) {
+				// the odd last row has the quiet zone below it
+				bottom = !invert
+			}
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// printQR writes the QR code to stdout for pairing over SSH, see -qr-stdout.
+func (s *session) printQR(content string) {
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		s.log.Errorf("Error rendering QR code: %s", err)
+		return
+	}
+	fmt.Printf("Scan the QR code to pair session %s:\n%s", s.name, qrASCII(code, false))
+}
+
+const (
+	defaultQRWait = 30 * time.Second
+	maxQRWait     = 2 * time.Minute
+)
+
+// handleQRWait long-polls the pairing: it answers once the QR code differs
+// from the one given as since, or the session is paired or its codes have
+// expired, and with status "pending" when nothing happened within timeout.
+func handleQRWait(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if authorize(sess, r, query.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		timeout := defaultQRWait
+		if value := query.Get("timeout"); value != "" {
+			var err error
+			timeout, err = time.ParseDuration(value)
+			if err != nil || timeout <= 0 || timeout > maxQRWait {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("timeout must be a duration up to " + maxQRWait.String()))
+				return
+			}
+		}
+		since := query.Get("since")
+		// waiting may take longer than -write-timeout allows
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		for {
+			state, changed := sess.state.Watch()
+			result := map[string]interface{}{"status": "pending"}
+			switch {
+			case state.Ready:
+				result["status"] = "paired"
+			case state.QRExpired:
+				result["status"] = "expired"
+			case state.QRCode != "" && state.QRCode != since:
+				result["status"] = "qr"
+				result["qrCode"] = state.QRCode
+				result["expiresIn"] = int(time.Until(state.QRExpires).Round(time.Second).Seconds())
+				result["index"] = state.QRIndex
+				result["total"] = state.QRTotal
+			}
+			if result["status"] != "pending" {
+				writeJSON(w, http.StatusOK, result)
+				return
+			}
+			select {
+			case <-changed:
+			case <-deadline.C:
+				writeJSON(w, http.StatusOK, result)
+				return
+			case <-r.Context().Done():
+				return
+			case <-shuttingDown:
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+}
+
+// handleQRNext skips to the next QR code of the sequence without waiting for
+// the current one to expire, the answer is the new code along with its index
+// from 0 and the number of codes.
+func handleQRNext(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if authorize(sess, r, r.URL.Query().Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		before, changed := sess.state.Watch()
+		if before.Ready {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("already logged in"))
+			return
+		}
+		if !sess.state.AdvanceQR() {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("no further QR code available"))
+			return
+		}
+		// the rotation picks the request up right away
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		state := sess.state.Snapshot()
+		if state.QRCode == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no QR code available"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"qrCode":    state.QRCode,
+			"index":     state.QRIndex,
+			"total":     state.QRTotal,
+			"expiresIn": int(time.Until(state.QRExpires).Round(time.Second).Seconds()),
+		})
+	}
+}
+
+func handleQR(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if authorize(sess, r, key) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		state := sess.state.Snapshot()
+		qrCode, qrExpires := state.QRCode, state.QRExpires
+		if state.Ready {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("already logged in"))
+			return
+		}
+		if state.QRExpired {
+			// POST asks for new codes, the login was dropped along with the
+			// last one
+			if r.Method == http.MethodPost && sess.state.TakeQRExpired() {
+				go sess.renewQR()
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte("requesting a new QR code"))
+				return
+			}
+			w.WriteHeader(http.StatusGone)
+			_, _ = w.Write([]byte("QR code expired, POST to request a new one"))
+			return
+		}
+		if qrCode == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no QR code available"))
+			return
+		}
+		var body []byte
+		var contentType string
+		switch format := qrFormat(r); format {
+		case "text":
+			body, contentType = []byte(qrCode), "text/plain; charset=utf-8"
+		case "svg", "ascii":
+			code, err := qrcode.New(qrCode, qrcode.Medium)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			if format == "svg" {
+				body, contentType = qrSVG(code), "image/svg+xml"
+				break
+			}
+			invert := r.URL.Query().Get("invert")
+			body, contentType = qrASCII(code, invert == "1" || invert == "true"), "text/plain; charset=utf-8"
+		case "png", "datauri":
+			png, err := qrPNG(qrCode)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			body, contentType = png, "image/png"
+			if format == "datauri" {
+				body = []byte("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+				contentType = "text/plain; charset=utf-8"
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("format must be one of png, svg, text, datauri or ascii"))
+			return
+		}
+		// lets polling clients know when to fetch the next code
+		w.Header().Set("X-QR-Expires-In", fmt.Sprintf("%d", int(time.Until(qrExpires).Round(time.Second).Seconds())))
+		w.Header().Set("X-QR-Index", fmt.Sprintf("%d", state.QRIndex))
+		w.Header().Set("X-QR-Total", fmt.Sprintf("%d", state.QRTotal))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(body)
+	}
+}
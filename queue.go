@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// queueAttempts is how many times a queued message is tried before it is
+// left in the queue as failed.
+const queueAttempts = 5
+
+// db is the database shared with the whatsmeow store, for the tables of the
+// service itself.
+var db *sql.DB
+
+func upgradeQueue() error {
+	idType, blobType := dbColumns.id, dbColumns.blob
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS messages_queue (
+		id         ` + idType + ` PRIMARY KEY,
+		session    TEXT    NOT NULL,
+		recipient  TEXT    NOT NULL,
+		message    ` + blobType + `    NOT NULL,
+		attempts   INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at INTEGER NOT NULL
+	)`)
+	return err
+}
+
+// enqueue persists msg for sending once the session is connected again.
+func (s *session) enqueue(to types.JID, msg *proto.Message) (int64, error) {
+	data, err := gproto.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	// the Postgres driver does not support LastInsertId
+	var id int64
+	err = db.QueryRow(
+		`INSERT INTO messages_queue (session, recipient, message, created_at) VALUES ($1, $2, $3, $4) RETURNING id`,
+		s.name, to.String(), data, time.Now().Unix(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	s.wakeQueue()
+	return id, nil
+}
+
+func (s *session) wakeQueue() {
+	select {
+	case s.queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// runQueue drains the queue whenever the session becomes ready, and from
+// time to time for the messages which failed previously.
+func (s *session) runQueue() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.queueWake:
+		case <-ticker.C:
+		}
+		if s.isReady() {
+			s.drainQueue()
+		}
+	}
+}
+
+type queuedMessage struct {
+	id        int64
+	recipient string
+	message   []byte
+	attempts  int
+}
+
+func (s *session) drainQueue() {
+	rows, err := db.Query(
+		`SELECT id, recipient, message, attempts FROM messages_queue WHERE session=$1 AND attempts<$2 ORDER BY id`,
+		s.name, queueAttempts,
+	)
+	if err != nil {
+		mainLog.Errorf("Error reading message queue: %s", err)
+		return
+	}
+	var pending []queuedMessage
+	for rows.Next() {
+		var m queuedMessage
+		if err = rows.Scan(&m.id, &m.recipient, &m.message, &m.attempts); err != nil {
+			mainLog.Errorf("Error reading message queue: %s", err)
+			break
+		}
+		pending = append(pending, m)
+	}
+	_ = rows.Close()
+	for _, m := range pending {
+		err = s.sendQueued(m)
+		if errors.Is(err, whatsmeow.ErrNotConnected) {
+			// wait for the next connection instead of burning attempts
+			return
+		}
+		if err != nil {
+			mainLog.Warnf("Error sending queued message %d: %s", m.id, err)
+			_, err = db.Exec(`UPDATE messages_queue SET attempts=$1, last_error=$2 WHERE id=$3`, m.attempts+1, err.Error(), m.id)
+		} else {
+			_, err = db.Exec(`DELETE FROM messages_queue WHERE id=$1`, m.id)
+		}
+		if err != nil {
+			mainLog.Errorf("Error updating message queue: %s", err)
+		}
+	}
+}
+
+func (s *session) sendQueued(m queuedMessage) error {
+	to, err := types.ParseJID(m.recipient)
+	if err != nil {
+		return err
+	}
+	msg := &proto.Message{}
+	if err = gproto.Unmarshal(m.message, msg); err != nil {
+		return err
+	}
+	_, _, err = s.send(context.Background(), to, msg)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter is a set of token buckets keyed by name, each refilled at rate
+// tokens per second up to burst tokens.
+type limiter struct {
+	rate  float64
+	burst float64
+
+	lock      sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// parseRate parses rates such as "10/minute" into a limiter, an empty rate
+// disables limiting and returns nil.
+func parseRate(rate string) (*limiter, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	count, unit, ok := strings.Cut(rate, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid rate %q, expected something like 10/minute", rate)
+	}
+	var per time.Duration
+	switch unit {
+	case "s", "sec", "second":
+		per = time.Second
+	case "m", "min", "minute":
+		per = time.Minute
+	case "h", "hour":
+		per = time.Hour
+	default:
+		return nil, fmt.Errorf("invalid rate unit %q, expected second, minute or hour", unit)
+	}
+	return &limiter{
+		rate:    float64(n) / per.Seconds(),
+		burst:   float64(n),
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// allow takes a token from the bucket of key, when none is left it returns
+// false along with how long until the next token is available.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund gives back a token taken by allow, for requests which got rejected
+// by another limiter afterwards.
+func (l *limiter) refund(key string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// sweep drops the buckets which have been refilled completely, so idle
+// destinations do not pile up. It must be called with the lock held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
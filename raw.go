@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// handleSendRaw sends a serialized proto.Message as it is, for the message
+// types the other endpoints do not build. It is only routed with -allow-raw.
+func handleSendRaw(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		data, _, err := readMedia(r, "message", req.Message)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		msg := &proto.Message{}
+		if err = gproto.Unmarshal(data, msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid message: " + err.Error()))
+			return
+		}
+		if gproto.Size(msg) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("message is empty"))
+			return
+		}
+		deliver(w, r, sess, jid, msg)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+var errNotOnWhatsApp = errors.New("number is not registered on WhatsApp")
+
+// normalizeJID parses to as a JID, bare phone numbers such as
+// "+60 12-345 6789" are turned into a user JID on the default server.
+func normalizeJID(to string) (types.JID, error) {
+	if strings.Contains(to, "@") {
+		return types.ParseJID(to)
+	}
+	number := phoneDigits(to)
+	if number == "" {
+		return types.JID{}, fmt.Errorf("invalid phone number %q", to)
+	}
+	return types.NewJID(number, types.DefaultUserServer), nil
+}
+
+// phoneDigits strips everything but the digits from a phone number.
+func phoneDigits(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+// resolveRecipient normalizes to and, when -check-numbers is set, confirms
+// that user JIDs are actually registered on WhatsApp. The check is skipped
+// for messages queued while logged out. A "group:" prefix looks up a joined
+// group by its name instead.
+func (s *session) resolveRecipient(to string) (types.JID, error) {
+	if name, ok := strings.CutPrefix(to, "group:"); ok {
+		return s.resolveGroup(strings.TrimSpace(name))
+	}
+	jid, err := normalizeJID(to)
+	if err != nil {
+		return jid, err
+	}
+	if !checkNumbers || jid.Server != types.DefaultUserServer || !s.isReady() {
+		return jid, nil
+	}
+	resp, err := s.Client().IsOnWhatsApp([]string{"+" + jid.User})
+	if err != nil {
+		return jid, fmt.Errorf("failed to check number: %w", err)
+	}
+	if len(resp) == 0 || !resp[0].IsIn {
+		return jid, fmt.Errorf("%w: %s", errNotOnWhatsApp, jid.User)
+	}
+	return resp[0].JID, nil
+}
+
+type checkResult struct {
+	Query string `json:"query"`
+	JID   string `json:"jid,omitempty"`
+	IsIn  bool   `json:"isIn"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleCheck reports for each of the comma separated numbers whether it is
+// registered on WhatsApp, invalid numbers are reported without failing the
+// whole request.
+func handleCheck(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Form.Get("numbers") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("numbers is required"))
+			return
+		}
+		queries := strings.Split(r.Form.Get("numbers"), ",")
+		results := make([]*checkResult, len(queries))
+		byPhone := make(map[string][]*checkResult)
+		var phones []string
+		for i, query := range queries {
+			query = strings.TrimSpace(query)
+			results[i] = &checkResult{Query: query}
+			number := phoneDigits(query)
+			if number == "" {
+				results[i].Error = "invalid phone number"
+				continue
+			}
+			phone := "+" + number
+			if _, ok := byPhone[phone]; !ok {
+				phones = append(phones, phone)
+			}
+			byPhone[phone] = append(byPhone[phone], results[i])
+		}
+		if len(phones) > 0 {
+			resp, err := sess.Client().IsOnWhatsApp(phones)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			for _, item := range resp {
+				for _, result := range byPhone[item.Query] {
+					result.IsIn = item.IsIn
+					if item.IsIn {
+						result.JID = item.JID.String()
+					}
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// replyContext is what a reply token stands for: the chat an incoming
+// message came from and the message itself, for quoting it.
+type replyContext struct {
+	session string
+	chat    types.JID
+	sender  types.JID
+	id      types.MessageID
+	text    string
+	expires time.Time
+}
+
+// replyTokens maps the replyToken of webhook payloads to their context for
+// -reply-token-ttl.
+var replyTokens = struct {
+	lock      sync.Mutex
+	byToken   map[string]*replyContext
+	lastSweep time.Time
+}{byToken: map[string]*replyContext{}}
+
+// issueReplyToken returns a token /send accepts instead of the chat and
+// quote of the message of evt, or nothing with -reply-token-ttl 0.
+func (s *session) issueReplyToken(evt *events.Message, text string) string {
+	if replyTokenTTL <= 0 {
+		return ""
+	}
+	// the request id format is as opaque and random as a token needs
+	token := newRequestID()
+	now := time.Now()
+	replyTokens.lock.Lock()
+	defer replyTokens.lock.Unlock()
+	if now.Sub(replyTokens.lastSweep) >= time.Minute {
+		replyTokens.lastSweep = now
+		for key, reply := range replyTokens.byToken {
+			if now.After(reply.expires) {
+				delete(replyTokens.byToken, key)
+			}
+		}
+	}
+	replyTokens.byToken[token] = &replyContext{
+		session: s.name,
+		chat:    evt.Info.Chat,
+		sender:  evt.Info.Sender.ToNonAD(),
+		id:      evt.Info.ID,
+		text:    text,
+		expires: now.Add(replyTokenTTL),
+	}
+	return token
+}
+
+// addReplyToken gives the payload of an incoming message its replyToken.
+func (s *session) addReplyToken(payload *messagePayload, evt *events.Message) {
+	if evt.Info.IsFromMe {
+		return
+	}
+	quoted := payload.Text
+	if quoted == "" {
+		quoted = payload.Caption
+	}
+	payload.ReplyToken = s.issueReplyToken(evt, quoted)
+}
+
+// lookupReplyToken returns the context of a token issued by the session s.
+func (s *session) lookupReplyToken(token string) (*replyContext, bool) {
+	replyTokens.lock.Lock()
+	defer replyTokens.lock.Unlock()
+	reply, ok := replyTokens.byToken[token]
+	if !ok || reply.session != s.name || time.Now().After(reply.expires) {
+		return nil, false
+	}
+	return reply, true
+}
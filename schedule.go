@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+const (
+	schedulePending   = "pending"
+	scheduleSending   = "sending"
+	scheduleSent      = "sent"
+	scheduleFailed    = "failed"
+	scheduleCancelled = "cancelled"
+)
+
+func upgradeSchedule() error {
+	idType, blobType := dbColumns.id, dbColumns.blob
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS scheduled_messages (
+		id         ` + idType + ` PRIMARY KEY,
+		session    TEXT    NOT NULL,
+		recipient  TEXT    NOT NULL,
+		message    ` + blobType + `    NOT NULL,
+		send_at    INTEGER NOT NULL,
+		status     TEXT    NOT NULL,
+		message_id TEXT,
+		last_error TEXT,
+		created_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	// a message claimed when the service stopped may not have been sent
+	_, err = db.Exec(`UPDATE scheduled_messages SET status=$1 WHERE status=$2`, schedulePending, scheduleSending)
+	return err
+}
+
+// schedule persists msg for sending at the given time.
+func (s *session) schedule(to types.JID, msg *proto.Message, at time.Time) (int64, error) {
+	data, err := gproto.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = db.QueryRow(
+		`INSERT INTO scheduled_messages (session, recipient, message, send_at, status, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		s.name, to.String(), data, at.Unix(), schedulePending, time.Now().Unix(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case s.scheduleWake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// runSchedule sends the scheduled messages once they are due, sleeping until
+// the next one or until a new one is scheduled. Pending messages are in the
+// database, so they are picked up again after a restart.
+func (s *session) runSchedule() {
+	for {
+		wait := time.Minute
+		var next int64
+		err := db.QueryRow(
+			`SELECT COALESCE(MIN(send_at), 0) FROM scheduled_messages WHERE session=$1 AND status=$2`,
+			s.name, schedulePending,
+		).Scan(&next)
+		if err != nil {
+			mainLog.Errorf("Error reading scheduled messages: %s", err)
+		} else if next != 0 {
+			if until := time.Until(time.Unix(next, 0)); until < wait {
+				wait = until
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.scheduleWake:
+				timer.Stop()
+				continue
+			}
+		}
+		if !s.isReady() || !s.sendDue() {
+			// not before the session is back, without sleeping this would spin
+			select {
+			case <-time.After(5 * time.Second):
+			case <-s.scheduleWake:
+			}
+		}
+	}
+}
+
+// sendDue sends the messages which are due, it returns false if it had to
+// stop for the connection.
+func (s *session) sendDue() bool {
+	rows, err := db.Query(
+		`SELECT id, recipient, message FROM scheduled_messages WHERE session=$1 AND status=$2 AND send_at<=$3 ORDER BY send_at, id`,
+		s.name, schedulePending, time.Now().Unix(),
+	)
+	if err != nil {
+		mainLog.Errorf("Error reading scheduled messages: %s", err)
+		return false
+	}
+	var due []queuedMessage
+	for rows.Next() {
+		var m queuedMessage
+		if err = rows.Scan(&m.id, &m.recipient, &m.message); err != nil {
+			mainLog.Errorf("Error reading scheduled messages: %s", err)
+			break
+		}
+		due = append(due, m)
+	}
+	_ = rows.Close()
+	for _, m := range due {
+		// claim the message first, so a cancel either lands before the send
+		// or gets a conflict
+		claimed, err := s.claimScheduled(m.id)
+		if err != nil {
+			mainLog.Errorf("Error updating scheduled messages: %s", err)
+			return false
+		}
+		if !claimed {
+			continue
+		}
+		id, err := s.sendScheduled(m)
+		if errors.Is(err, whatsmeow.ErrNotConnected) {
+			_, err = db.Exec(`UPDATE scheduled_messages SET status=$1 WHERE id=$2 AND status=$3`, schedulePending, m.id, scheduleSending)
+			if err != nil {
+				mainLog.Errorf("Error updating scheduled messages: %s", err)
+			}
+			return false
+		}
+		if err != nil {
+			mainLog.Warnf("Error sending scheduled message %d: %s", m.id, err)
+			_, err = db.Exec(`UPDATE scheduled_messages SET status=$1, last_error=$2 WHERE id=$3 AND status=$4`, scheduleFailed, err.Error(), m.id, scheduleSending)
+		} else {
+			_, err = db.Exec(`UPDATE scheduled_messages SET status=$1, message_id=$2 WHERE id=$3 AND status=$4`, scheduleSent, id, m.id, scheduleSending)
+		}
+		if err != nil {
+			mainLog.Errorf("Error updating scheduled messages: %s", err)
+		}
+	}
+	return true
+}
+
+// claimScheduled moves a pending message to sending, it returns false if the
+// message is no longer pending.
+func (s *session) claimScheduled(id int64) (bool, error) {
+	result, err := db.Exec(
+		`UPDATE scheduled_messages SET status=$1 WHERE id=$2 AND status=$3`,
+		scheduleSending, id, schedulePending,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *session) sendScheduled(m queuedMessage) (types.MessageID, error) {
+	to, err := types.ParseJID(m.recipient)
+	if err != nil {
+		return "", err
+	}
+	msg := &proto.Message{}
+	if err = gproto.Unmarshal(m.message, msg); err != nil {
+		return "", err
+	}
+	resp, _, err := s.send(context.Background(), to, msg)
+	return resp.ID, err
+}
+
+// parseScheduleAt reads the scheduleAt timestamp of a request, which has to
+// be in the future.
+func parseScheduleAt(value string) (time.Time, error) {
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("scheduleAt must be an RFC3339 timestamp")
+	}
+	if !at.After(time.Now()) {
+		return time.Time{}, errors.New("scheduleAt must be in the future")
+	}
+	return at, nil
+}
+
+// handleSchedule shows a scheduled message on GET and cancels it, as long as
+// it has not been sent, on DELETE.
+func handleSchedule(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/schedule/"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var recipient, status string
+		var sendAt int64
+		var messageID, lastError sql.NullString
+		err = db.QueryRow(
+			`SELECT recipient, send_at, status, message_id, last_error FROM scheduled_messages WHERE id=$1 AND session=$2`,
+			id, sess.name,
+		).Scan(&recipient, &sendAt, &status, &messageID, &lastError)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown schedule id"))
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			result, err := db.Exec(
+				`UPDATE scheduled_messages SET status=$1 WHERE id=$2 AND status=$3`,
+				scheduleCancelled, id, schedulePending,
+			)
+			var n int64
+			if err == nil {
+				n, err = result.RowsAffected()
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			if n == 0 {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte("message is already " + status))
+				return
+			}
+			status = scheduleCancelled
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		entry := map[string]interface{}{
+			"id":         id,
+			"to":         recipient,
+			"scheduleAt": time.Unix(sendAt, 0).UTC().Format(time.RFC3339),
+			"status":     status,
+		}
+		if messageID.Valid {
+			entry["messageId"] = messageID.String
+		}
+		if lastError.Valid {
+			entry["error"] = lastError.String
+		}
+		writeJSON(w, http.StatusOK, entry)
+	}
+}
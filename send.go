@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+type sendRequest struct {
+	Key string `json:"key"`
+	// To lists the recipients, a comma separated string or a JSON array.
+	To      recipientList `json:"to"`
+	Text    string        `json:"text"`
+	Caption string        `json:"caption"`
+	// Image and Document are the base64 encoded media of /send/image and
+	// /send/document, multipart uploads use the file part of the same name.
+	Image    string `json:"image"`
+	Document string `json:"document"`
+	// Video and Thumbnail are the base64 encoded video of /send/video and
+	// its JPEG preview, GIF sends the video as a looping GIF.
+	Video     string `json:"video"`
+	Thumbnail string `json:"thumbnail"`
+	GIF       bool   `json:"gif"`
+	// Sticker is the base64 encoded WebP, or PNG, image of /send/sticker.
+	Sticker string `json:"sticker"`
+	// Audio is the base64 encoded audio of /send/audio, PTT marks it as a
+	// voice note.
+	Audio    string `json:"audio"`
+	PTT      bool   `json:"ptt"`
+	FileName string `json:"filename"`
+	Mimetype string `json:"mimetype"`
+	// Latitude, Longitude, Name and Address describe the location sent by
+	// /send/location.
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Name      string   `json:"name"`
+	Address   string   `json:"address"`
+	// MessageID and Sender refer to an existing message, e.g. the one a
+	// reaction is for. Sender may be left out outside of groups.
+	MessageID string `json:"messageId"`
+	Sender    string `json:"sender"`
+	Emoji     string `json:"emoji"`
+	// QuotedID, QuotedParticipant and QuotedText turn a text message into a
+	// reply, see quoteContext.
+	QuotedID          string `json:"quotedId"`
+	QuotedParticipant string `json:"quotedParticipant"`
+	QuotedText        string `json:"quotedText"`
+	// Phone and Vcard describe the contact card of /send/contact, Contacts
+	// sends several of them at once.
+	Phone    string        `json:"phone"`
+	Vcard    string        `json:"vcard"`
+	Contacts []contactCard `json:"contacts"`
+	// Question, Options and SelectableCount make up the poll of /send/poll,
+	// a SelectableCount of 0 allows voting for any number of options.
+	Question        string   `json:"question"`
+	Options         []string `json:"options"`
+	SelectableCount int      `json:"selectableCount"`
+	// Buttons and Footer make up the interactive message of /send/buttons
+	// along with Text.
+	Buttons []button `json:"buttons"`
+	Footer  string   `json:"footer"`
+	// Title, ButtonText and Sections make up the list of /send/list, Text
+	// and Footer describe it.
+	Title      string        `json:"title"`
+	ButtonText string        `json:"buttonText"`
+	Sections   []listSection `json:"sections"`
+	// BackgroundColor and Font style the text statuses of /send/status.
+	BackgroundColor string `json:"backgroundColor"`
+	Font            string `json:"font"`
+	// Vars fill in the placeholders of the template of /send/template, which
+	// is picked by Name.
+	Vars map[string]string `json:"vars"`
+	// ReplyToken comes from a webhook payload and stands for its chat as
+	// the recipient, replies to /send also quote its message.
+	ReplyToken string `json:"replyToken"`
+	// Mentions are the numbers mentioned in the text of /send, which must
+	// contain an @number token for each of them.
+	Mentions []string `json:"mentions"`
+	// Message is the base64 encoded serialized proto.Message of /send/raw.
+	Message string `json:"message"`
+	// Ephemeral makes the text of /send disappear after this many seconds,
+	// one of the timers of disappearingTimers.
+	Ephemeral int `json:"ephemeral"`
+	// ForMe makes /revoke delete the message on the account only.
+	ForMe bool `json:"forMe"`
+	// Preview attaches the OpenGraph preview of the first link in Text.
+	Preview bool `json:"preview"`
+	// ScheduleAt is an RFC3339 timestamp to send the text of /send at
+	// instead of right away.
+	ScheduleAt string `json:"scheduleAt"`
+	// DryRun stops after the recipient and permission checks, see
+	// prepareSend.
+	DryRun bool `json:"dryRun"`
+	// WaitDelivered holds the answer of a /send to a single recipient until
+	// the message reached the phone, for at most -wait-delivered-timeout. It
+	// can not be combined with several recipients or ScheduleAt, messages
+	// queued by -queue are answered with their queue id right away.
+	WaitDelivered bool `json:"waitDelivered"`
+}
+
+type recipientList []string
+
+func (l *recipientList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var to string
+	if err := json.Unmarshal(data, &to); err != nil {
+		return errors.New("to must be a string or an array of strings")
+	}
+	*l = splitList(to)
+	return nil
+}
+
+// splitList splits a comma separated list, dropping blank entries.
+func splitList(to string) []string {
+	var list []string
+	for _, entry := range strings.Split(to, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// readSendRequest reads the /send parameters either from a JSON body or from
+// the url-encoded form, depending on the request content type.
+func readSendRequest(r *http.Request) (*sendRequest, error) {
+	req := &sendRequest{}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid json body: %w", err)
+		}
+		if req.Key == "" {
+			req.Key = r.URL.Query().Get("key")
+		}
+		return req, nil
+	}
+	if contentType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("invalid form body: %w", err)
+	}
+	req.Key = r.Form.Get("key")
+	for _, to := range r.Form["to"] {
+		req.To = append(req.To, splitList(to)...)
+	}
+	req.Text = r.Form.Get("text")
+	req.Caption = r.Form.Get("caption")
+	req.Image = r.Form.Get("image")
+	req.Document = r.Form.Get("document")
+	req.Video = r.Form.Get("video")
+	req.Thumbnail = r.Form.Get("thumbnail")
+	req.Sticker = r.Form.Get("sticker")
+	req.Audio = r.Form.Get("audio")
+	req.FileName = r.Form.Get("filename")
+	req.Mimetype = r.Form.Get("mimetype")
+	req.Name = r.Form.Get("name")
+	req.Address = r.Form.Get("address")
+	req.Phone = r.Form.Get("phone")
+	req.Vcard = r.Form.Get("vcard")
+	req.Question = r.Form.Get("question")
+	req.Options = r.Form["options"]
+	req.Mentions = r.Form["mentions"]
+	req.ReplyToken = r.Form.Get("replyToken")
+	// buttons given as form values are their own ids
+	for _, text := range r.Form["buttons"] {
+		req.Buttons = append(req.Buttons, button{ID: text, Text: text})
+	}
+	req.Footer = r.Form.Get("footer")
+	req.ScheduleAt = r.Form.Get("scheduleAt")
+	req.Title = r.Form.Get("title")
+	req.ButtonText = r.Form.Get("buttonText")
+	req.MessageID = r.Form.Get("messageId")
+	req.Sender = r.Form.Get("sender")
+	req.Emoji = r.Form.Get("emoji")
+	req.QuotedID = r.Form.Get("quotedId")
+	req.QuotedParticipant = r.Form.Get("quotedParticipant")
+	req.QuotedText = r.Form.Get("quotedText")
+	req.BackgroundColor = r.Form.Get("backgroundColor")
+	req.Font = r.Form.Get("font")
+	req.Message = r.Form.Get("message")
+	var err error
+	if req.Latitude, err = formFloat(r, "latitude"); err != nil {
+		return nil, err
+	}
+	if req.Longitude, err = formFloat(r, "longitude"); err != nil {
+		return nil, err
+	}
+	if req.PTT, err = formBool(r, "ptt"); err != nil {
+		return nil, err
+	}
+	if req.GIF, err = formBool(r, "gif"); err != nil {
+		return nil, err
+	}
+	if req.ForMe, err = formBool(r, "forMe"); err != nil {
+		return nil, err
+	}
+	if req.Preview, err = formBool(r, "preview"); err != nil {
+		return nil, err
+	}
+	if req.DryRun, err = formBool(r, "dryRun"); err != nil {
+		return nil, err
+	}
+	if req.WaitDelivered, err = formBool(r, "waitDelivered"); err != nil {
+		return nil, err
+	}
+	if value := r.Form.Get("vars"); value != "" {
+		if err = json.Unmarshal([]byte(value), &req.Vars); err != nil {
+			return nil, fmt.Errorf("invalid vars: %s", err)
+		}
+	}
+	// sections are too nested for form values, they come as JSON
+	if value := r.Form.Get("sections"); value != "" {
+		if err = json.Unmarshal([]byte(value), &req.Sections); err != nil {
+			return nil, fmt.Errorf("invalid sections: %s", err)
+		}
+	}
+	if value := r.Form.Get("ephemeral"); value != "" {
+		if req.Ephemeral, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid ephemeral: %s", value)
+		}
+	}
+	if value := r.Form.Get("selectableCount"); value != "" {
+		if req.SelectableCount, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid selectableCount: %s", value)
+		}
+	}
+	return req, nil
+}
+
+// formFloat parses an optional numeric form field.
+func formFloat(r *http.Request, field string) (*float64, error) {
+	value := r.Form.Get(field)
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", field, value)
+	}
+	return &f, nil
+}
+
+// formBool parses an optional boolean form field, which defaults to false.
+func formBool(r *http.Request, field string) (bool, error) {
+	value := r.Form.Get(field)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", field, value)
+	}
+	return b, nil
+}
+
+// readSend runs the checks shared by the send endpoints up to the point
+// where the recipients are known, it writes the error response and returns
+// false when the request can not go on. Queueable requests go on while the
+// session is not ready if -queue is set.
+func readSend(sess *session, w http.ResponseWriter, r *http.Request, queueable bool) (*sendRequest, *keyACL, bool) {
+	if !sess.isReady() && !(queueable && queueMode) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+	req, err := readSendRequest(r)
+	if err != nil {
+		bodyError(w, err)
+		return nil, nil, false
+	}
+	acl := authorize(sess, r, req.Key)
+	if acl == nil {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("403 Forbidden"))
+		return nil, nil, false
+	}
+	if req.ReplyToken != "" {
+		if len(req.To) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("replyToken and to can not be used together"))
+			return nil, nil, false
+		}
+		reply, ok := sess.lookupReplyToken(req.ReplyToken)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid or expired replyToken"))
+			return nil, nil, false
+		}
+		req.To = recipientList{reply.chat.String()}
+		if req.QuotedID == "" {
+			req.QuotedID = reply.id
+			req.QuotedParticipant = reply.sender.String()
+			req.QuotedText = reply.text
+		}
+	}
+	if len(req.To) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("to is required"))
+		return nil, nil, false
+	}
+	return req, acl, true
+}
+
+// prepareSend is readSend followed by target for the endpoints which send to
+// a single recipient.
+func prepareSend(sess *session, w http.ResponseWriter, r *http.Request, queueable bool) (*sendRequest, types.JID, bool) {
+	req, acl, ok := readSend(sess, w, r, queueable)
+	if !ok {
+		return nil, types.JID{}, false
+	}
+	if len(req.To) > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("this endpoint sends to a single recipient only"))
+		return nil, types.JID{}, false
+	}
+	jid, ok := sess.target(w, acl, req)
+	return req, jid, ok
+}
+
+// target checks the only recipient of req and writes the error response
+// when it can not be sent to. Dry runs are answered here once the recipient
+// has been resolved, before they count against the rate limits.
+func (s *session) target(w http.ResponseWriter, acl *keyACL, req *sendRequest) (types.JID, bool) {
+	jid, sendErr := s.checkRecipient(acl, req.To[0], req.DryRun)
+	if sendErr != nil {
+		sendErr.write(w)
+		return types.JID{}, false
+	}
+	if req.DryRun {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"dryRun":      true,
+			"resolvedJid": jid.String(),
+		})
+		return types.JID{}, false
+	}
+	return jid, true
+}
+
+// sendError is a rejected recipient along with the status it is answered
+// with.
+type sendError struct {
+	status     int
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) write(w http.ResponseWriter) {
+	if e.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+	}
+	w.WriteHeader(e.status)
+	_, _ = w.Write([]byte(e.err.Error()))
+}
+
+// checkRecipient resolves to and checks that the key may send to it, dry
+// runs are not rate limited.
+func (s *session) checkRecipient(acl *keyACL, to string, dryRun bool) (types.JID, *sendError) {
+	jid, err := s.resolveRecipient(to)
+	if errors.Is(err, errNotOnWhatsApp) || errors.Is(err, errUnknownGroup) {
+		return jid, &sendError{status: http.StatusUnprocessableEntity, err: err}
+	} else if err != nil {
+		return jid, &sendError{status: http.StatusBadRequest, err: err}
+	}
+	if !acl.allowsDestination(jid) {
+		return jid, &sendError{status: http.StatusForbidden, err: errors.New("destination not allowed for this key")}
+	}
+	if sendErr := s.checkContact(acl, jid); sendErr != nil {
+		return jid, sendErr
+	}
+	if dryRun {
+		return jid, nil
+	}
+	if ok, retryAfter := s.allowSend(jid); !ok {
+		return jid, &sendError{status: http.StatusTooManyRequests, retryAfter: retryAfter, err: errors.New("rate limit exceeded")}
+	}
+	return jid, nil
+}
+
+// checkContact refuses users outside the contact store for keys limited to
+// contacts, groups are always allowed.
+func (s *session) checkContact(acl *keyACL, jid types.JID) *sendError {
+	if !acl.contactsOnly() || jid.Server != types.DefaultUserServer {
+		return nil
+	}
+	cli := s.Client()
+	if cli == nil {
+		return &sendError{status: http.StatusServiceUnavailable, err: errors.New("session is not connected")}
+	}
+	contact, err := cli.Store.Contacts.GetContact(jid.ToNonAD())
+	if err != nil {
+		return &sendError{status: http.StatusInternalServerError, err: err}
+	}
+	if !contact.Found {
+		return &sendError{status: http.StatusForbidden, err: errors.New("destination is not a contact")}
+	}
+	return nil
+}
+
+// allowSend applies the destination and global rate limits, returning how
+// long to wait once either of them is exhausted.
+func (s *session) allowSend(to types.JID) (bool, time.Duration) {
+	current := currentSettings()
+	destination := s.name + "/" + to.ToNonAD().String()
+	ok, retryAfter := current.destinationLimiter.allow(destination)
+	if ok {
+		ok, retryAfter = current.globalLimiter.allow(s.name)
+		if !ok {
+			current.destinationLimiter.refund(destination)
+		}
+	}
+	return ok, retryAfter
+}
+
+// writeSendResponse reports the id and server timestamp of a sent message so
+// callers can correlate it with receipts later on.
+func writeSendResponse(w http.ResponseWriter, resp whatsmeow.SendResponse) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":        resp.ID,
+		"timestamp": resp.Timestamp.Unix(),
+	})
+}
+
+// setAttempts reports how many tries a send took in the X-Attempts header.
+func setAttempts(w http.ResponseWriter, attempts int) {
+	w.Header().Set("X-Attempts", strconv.Itoa(attempts))
+}
+
+func handleSend(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, acl, ok := readSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		if req.Text == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("text is required"))
+			return
+		}
+		if !disappearingTimers[req.Ephemeral] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("ephemeral must be 0, 86400, 604800 or 7776000 seconds"))
+			return
+		}
+		if _, err := mentionedJIDs(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		var scheduleAt time.Time
+		if req.ScheduleAt != "" {
+			var err error
+			if scheduleAt, err = parseScheduleAt(req.ScheduleAt); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+		}
+		if req.WaitDelivered && (len(req.To) > 1 || !scheduleAt.IsZero()) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("waitDelivered needs a single recipient and no scheduleAt"))
+			return
+		}
+		var preview *linkPreview
+		if req.Preview && !req.DryRun {
+			var err error
+			// the text is sent as it is when there is nothing to show
+			if preview, err = fetchPreview(req.Text); err != nil {
+				sess.log.Warnf("Error fetching link preview: %s", err)
+			}
+		}
+		if len(req.To) > 1 {
+			sendBatch(w, r, sess, acl, req, preview, scheduleAt)
+			return
+		}
+		jid, ok := sess.target(w, acl, req)
+		if !ok {
+			return
+		}
+		msg, err := textMessage(jid, req, preview)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if !scheduleAt.IsZero() {
+			id, err := sess.schedule(jid, msg, scheduleAt)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{
+				"scheduleId": id,
+			})
+			return
+		}
+		if req.WaitDelivered {
+			deliverConfirmed(w, r, sess, jid, msg)
+			return
+		}
+		deliver(w, r, sess, jid, msg)
+	}
+}
+
+// deliverConfirmed is deliver waiting for the delivery receipt as well, the
+// answer is 200 with deliveredAt once it arrived and 202 if it did not
+// within -wait-delivered-timeout, the message has been sent either way.
+func deliverConfirmed(w http.ResponseWriter, r *http.Request, sess *session, to types.JID, msg *proto.Message) {
+	d, err := sess.dispatch(r.Context(), to, msg)
+	if d.attempts > 0 {
+		setAttempts(w, d.attempts)
+	}
+	if err != nil {
+		writeSendError(w, err)
+		return
+	}
+	if d.queueID != 0 {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"queueId": d.queueID,
+		})
+		return
+	}
+	// waiting may take longer than -write-timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(waitDeliveredTimeout + 10*time.Second))
+	ctx, cancel := context.WithTimeout(r.Context(), waitDeliveredTimeout)
+	defer cancel()
+	result := map[string]interface{}{
+		"id":        d.resp.ID,
+		"timestamp": d.resp.Timestamp.Unix(),
+	}
+	delivered, ok := waitDelivered(ctx, d.resp.ID)
+	if !ok {
+		result["status"] = statusSent
+		writeJSON(w, http.StatusAccepted, result)
+		return
+	}
+	result["status"] = statusDelivered
+	result["deliveredAt"] = delivered.Unix()
+	writeJSON(w, http.StatusOK, result)
+}
+
+// sendBatch sends the text of req to each of its recipients, or schedules it
+// when scheduleAt is set, and answers 207 with the outcome for every one of
+// them, failures do not stop the batch.
+func sendBatch(w http.ResponseWriter, r *http.Request, sess *session, acl *keyACL, req *sendRequest, preview *linkPreview, scheduleAt time.Time) {
+	results := make([]map[string]interface{}, 0, len(req.To))
+	for _, to := range req.To {
+		result := map[string]interface{}{"to": to}
+		results = append(results, result)
+		jid, sendErr := sess.checkRecipient(acl, to, req.DryRun)
+		if sendErr != nil {
+			result["error"] = sendErr.Error()
+			continue
+		}
+		if req.DryRun {
+			result["resolvedJid"] = jid.String()
+			continue
+		}
+		msg, err := textMessage(jid, req, preview)
+		if err != nil {
+			result["error"] = err.Error()
+			continue
+		}
+		if !scheduleAt.IsZero() {
+			if id, err := sess.schedule(jid, msg, scheduleAt); err != nil {
+				result["error"] = err.Error()
+			} else {
+				result["scheduleId"] = id
+			}
+			continue
+		}
+		d, err := sess.dispatch(r.Context(), jid, msg)
+		if d.attempts > 0 {
+			result["attempts"] = d.attempts
+		}
+		switch {
+		case err != nil:
+			_, code := classifySendError(err)
+			result["error"] = err.Error()
+			result["code"] = code
+		case d.queueID != 0:
+			result["queueId"] = d.queueID
+		default:
+			result["id"] = d.resp.ID
+		}
+	}
+	writeJSON(w, http.StatusMultiStatus, results)
+}
+
+// disappearingTimers are the timers WhatsApp offers for disappearing
+// messages in seconds: off, 24 hours, 7 days and 90 days.
+var disappearingTimers = map[int]bool{0: true, 86400: true, 604800: true, 7776000: true}
+
+// mentionedJIDs resolves the mentions of req to user JIDs, WhatsApp only
+// highlights a mention which also appears as @number in the text.
+func mentionedJIDs(req *sendRequest) ([]string, error) {
+	mentioned := make([]string, 0, len(req.Mentions))
+	for _, mention := range req.Mentions {
+		number := phoneDigits(mention)
+		if number == "" {
+			return nil, fmt.Errorf("invalid mention %q", mention)
+		}
+		if !hasMention(req.Text, number) {
+			return nil, fmt.Errorf("text does not mention @%s", number)
+		}
+		mentioned = append(mentioned, types.NewJID(number, types.DefaultUserServer).String())
+	}
+	return mentioned, nil
+}
+
+// hasMention tells whether text contains @number on its own, not as the
+// start of a longer number.
+func hasMention(text, number string) bool {
+	token := "@" + number
+	for rest := text; ; {
+		i := strings.Index(rest, token)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(token):]
+		if rest == "" || rest[0] < '0' || rest[0] > '9' {
+			return true
+		}
+	}
+}
+
+// textMessage builds the message of /send for the chat, a reply when
+// QuotedID is set, disappearing when Ephemeral is, mentioning Mentions and
+// with the link preview when there is one.
+func textMessage(chat types.JID, req *sendRequest, preview *linkPreview) (*proto.Message, error) {
+	if req.QuotedID == "" && preview == nil && req.Ephemeral == 0 && len(req.Mentions) == 0 {
+		return &proto.Message{Conversation: gproto.String(req.Text)}, nil
+	}
+	// plain conversations can carry neither a context nor a preview
+	text := &proto.ExtendedTextMessage{Text: gproto.String(req.Text)}
+	if req.QuotedID != "" {
+		quote, err := quoteContext(chat, req)
+		if err != nil {
+			return nil, err
+		}
+		text.ContextInfo = quote
+	}
+	if req.Ephemeral != 0 {
+		if text.ContextInfo == nil {
+			text.ContextInfo = &proto.ContextInfo{}
+		}
+		text.ContextInfo.Expiration = gproto.Uint32(uint32(req.Ephemeral))
+	}
+	if len(req.Mentions) > 0 {
+		mentioned, err := mentionedJIDs(req)
+		if err != nil {
+			return nil, err
+		}
+		if text.ContextInfo == nil {
+			text.ContextInfo = &proto.ContextInfo{}
+		}
+		text.ContextInfo.MentionedJid = mentioned
+	}
+	if preview != nil {
+		text.MatchedText = gproto.String(preview.matchedText)
+		text.CanonicalUrl = gproto.String(preview.url)
+		text.Title = gproto.String(preview.title)
+		text.Description = gproto.String(preview.description)
+		text.JpegThumbnail = preview.thumbnail
+		text.PreviewType = proto.ExtendedTextMessage_NONE.Enum()
+	}
+	return &proto.Message{ExtendedTextMessage: text}, nil
+}
+
+// quoteContext builds the context of a reply. WhatsApp needs the id of the
+// quoted message (StanzaId), its sender (Participant, which defaults to the
+// chat outside of groups) and a QuotedMessage, even an empty one, to render
+// the quote. QuotedText fills in the preview when the recipient does not
+// have the original message anymore.
+func quoteContext(chat types.JID, req *sendRequest) (*proto.ContextInfo, error) {
+	participant, err := messageSender(chat, req.QuotedParticipant)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.ContextInfo{
+		StanzaId:    gproto.String(req.QuotedID),
+		Participant: gproto.String(participant.String()),
+		QuotedMessage: &proto.Message{
+			Conversation: gproto.String(req.QuotedText),
+		},
+	}, nil
+}
+
+// delivery is the outcome of dispatch, queueID is set instead of resp for
+// queued messages.
+type delivery struct {
+	resp     whatsmeow.SendResponse
+	queueID  int64
+	attempts int
+}
+
+// dispatch sends msg, with -queue set the message is queued instead while
+// the session is not connected.
+func (s *session) dispatch(ctx context.Context, to types.JID, msg *proto.Message) (delivery, error) {
+	var d delivery
+	var err error
+	if !queueMode || s.isReady() {
+		d.resp, d.attempts, err = s.send(ctx, to, msg)
+		if !queueMode || !errors.Is(err, whatsmeow.ErrNotConnected) {
+			return d, err
+		}
+	}
+	d.queueID, err = s.enqueue(to, msg)
+	return d, err
+}
+
+// deliver dispatches msg for the request r and writes the response, 202
+// with the queue id for queued messages.
+func deliver(w http.ResponseWriter, r *http.Request, sess *session, to types.JID, msg *proto.Message) {
+	d, err := sess.dispatch(r.Context(), to, msg)
+	if d.attempts > 0 {
+		setAttempts(w, d.attempts)
+	}
+	if err != nil {
+		writeSendError(w, err)
+		return
+	}
+	if d.queueID != 0 {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"queueId": d.queueID,
+		})
+		return
+	}
+	writeSendResponse(w, d.resp)
+}
+
+// classifySendError maps a send error to the status answered for it and a
+// code clients can branch on, the message itself is not meant for matching.
+func classifySendError(err error) (int, string) {
+	var iqErr *whatsmeow.IQError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, whatsmeow.ErrIQTimedOut), errors.Is(err, whatsmeow.ErrMessageTimedOut):
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, whatsmeow.ErrNotConnected):
+		return http.StatusServiceUnavailable, "not_connected"
+	case errors.Is(err, whatsmeow.ErrNotLoggedIn):
+		return http.StatusServiceUnavailable, "not_logged_in"
+	case errors.Is(err, whatsmeow.ErrRecipientADJID), errors.Is(err, whatsmeow.ErrUnknownServer),
+		errors.Is(err, whatsmeow.ErrBroadcastListUnsupported):
+		return http.StatusUnprocessableEntity, "invalid_recipient"
+	case errors.Is(err, whatsmeow.ErrNoSession):
+		// the recipient has no devices to encrypt the message for
+		return http.StatusUnprocessableEntity, "no_session"
+	case errors.Is(err, whatsmeow.ErrIQResourceLimit), errors.As(err, &iqErr) && iqErr.Code == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests, "rate_limited"
+	case errors.Is(err, whatsmeow.ErrServerReturnedError):
+		return http.StatusBadGateway, "server_error"
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, "canceled"
+	default:
+		return http.StatusInternalServerError, "send_failed"
+	}
+}
+
+// writeSendError answers a failed send with its status and an error body of
+// {"error", "code"}.
+func writeSendError(w http.ResponseWriter, err error) {
+	status, code := classifySendError(err)
+	writeJSON(w, status, map[string]interface{}{
+		"error": err.Error(),
+		"code":  code,
+	})
+}
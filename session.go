@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// session is a single WhatsApp account managed by the service.
+type session struct {
+	name   string
+	device *store.Device
+	log    waLog.Logger
+	// shutdown is called when the session can not recover by itself.
+	shutdown func()
+
+	state sessionState
+	// events reaches the websocket clients of /ws, stream the ones of
+	// /events.
+	events eventHub
+	stream eventLog
+
+	// lock guards device, client, presence, subscriptions, presenceWaiters,
+	// missingDevice and the groups cache.
+	lock   sync.RWMutex
+	client *whatsmeow.Client
+	// presence is the last presence announced with client.
+	presence types.Presence
+	// subscriptions are the contacts whose presence is subscribed to.
+	subscriptions map[types.JID]bool
+	// presenceWaiters are the /lastseen requests waiting for the presence
+	// of a contact.
+	presenceWaiters map[types.JID][]chan *events.Presence
+	// reconnecting is set while reconnect is running.
+	reconnecting bool
+	// missingDevice is the JID configured for the session when its device
+	// could not be loaded, it is cleared once a new device is paired.
+	missingDevice string
+	// queueWake nudges the queue runner to send the queued messages.
+	queueWake chan struct{}
+	// scheduleWake tells the scheduler a message has been scheduled.
+	scheduleWake chan struct{}
+	// batchWake tells the batch runner about a new job.
+	batchWake chan struct{}
+	// groups caches the joined groups for resolving recipients by name.
+	groups        []*types.GroupInfo
+	groupsFetched time.Time
+}
+
+var sessions = struct {
+	lock   sync.RWMutex
+	byName map[string]*session
+	// names keeps the configured order, the first one is the default session.
+	names []string
+}{byName: map[string]*session{}}
+
+func allSessions() []*session {
+	sessions.lock.RLock()
+	defer sessions.lock.RUnlock()
+	all := make([]*session, 0, len(sessions.names))
+	for _, name := range sessions.names {
+		all = append(all, sessions.byName[name])
+	}
+	return all
+}
+
+// lookupSession returns the session called name, or the default session
+// for an empty name, nil if there is no such session.
+func lookupSession(name string) *session {
+	sessions.lock.RLock()
+	defer sessions.lock.RUnlock()
+	if name == "" && len(sessions.names) > 0 {
+		name = sessions.names[0]
+	}
+	return sessions.byName[name]
+}
+
+// loadSessions resolves the -sessions flag, a comma separated list of
+// name=jid entries, to devices in the store. A name without a JID takes the
+// first device which is not claimed by another entry, or a brand-new one.
+func loadSessions(container *sqlstore.Container, spec string, clientLog waLog.Logger) error {
+	if spec == "" {
+		spec = "default"
+	}
+	devices, err := container.GetAllDevices()
+	if err != nil {
+		return err
+	}
+	claimed := make(map[types.JID]bool)
+	var unassigned []*session
+	for _, entry := range strings.Split(spec, ",") {
+		name, jidStr, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid session name %q", name)
+		}
+		if _, ok := sessions.byName[name]; ok {
+			return fmt.Errorf("duplicated session %q", name)
+		}
+		s := &session{
+			name:            name,
+			log:             clientLog.Sub(name),
+			queueWake:       make(chan struct{}, 1),
+			scheduleWake:    make(chan struct{}, 1),
+			batchWake:       make(chan struct{}, 1),
+			subscriptions:   make(map[types.JID]bool),
+			presenceWaiters: make(map[types.JID][]chan *events.Presence),
+		}
+		if jidStr != "" {
+			jid, err := types.ParseJID(jidStr)
+			if err != nil {
+				return fmt.Errorf("invalid jid for session %q: %w", name, err)
+			}
+			s.device, err = container.GetDevice(jid)
+			if err != nil {
+				return err
+			}
+			claimed[jid] = true
+			if !validDevice(s.device) {
+				// pairing again beats refusing to start, /ready tells why
+				mainLog.Errorf("No usable device found for session %q (%s), it has to be paired again", name, jid)
+				s.device = container.NewDevice()
+				s.missingDevice = jid.String()
+			}
+		} else {
+			unassigned = append(unassigned, s)
+		}
+		sessions.byName[name] = s
+		sessions.names = append(sessions.names, name)
+	}
+	for _, s := range unassigned {
+		for _, device := range devices {
+			if !validDevice(device) {
+				mainLog.Warnf("Skipping unusable device %v in the store", device.ID)
+				continue
+			}
+			if !claimed[*device.ID] {
+				claimed[*device.ID] = true
+				s.device = device
+				break
+			}
+		}
+		if s.device == nil {
+			s.device = container.NewDevice()
+		}
+	}
+	return nil
+}
+
+// validDevice tells whether a device from the store can log in, devices
+// left half written by a crash or a damaged database lack their ID or keys.
+func validDevice(device *store.Device) bool {
+	return device != nil && device.ID != nil && device.ID.User != "" &&
+		device.NoiseKey != nil && device.IdentityKey != nil && device.SignedPreKey != nil
+}
+
+func (s *session) Client() *whatsmeow.Client {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.client
+}
+
+// isReady tells whether the session is logged in, a client which lost its
+// device along the way is not.
+func (s *session) isReady() bool {
+	if !s.state.Snapshot().Ready {
+		return false
+	}
+	cli := s.Client()
+	return cli != nil && cli.Store.ID != nil
+}
+
+// setReady updates the login state and tells the /ws clients when it
+// changed, like rotateQR does for every QR code.
+func (s *session) setReady(ready bool) {
+	if s.state.SetReady(ready) {
+		s.events.publish(s.statePayload())
+	}
+}
+
+// sendContext limits ctx to -send-timeout. Handlers which upload media
+// derive it once and pass it to upload and send, so both share the one
+// deadline.
+func sendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sendTimeout > 0 {
+		return context.WithTimeout(ctx, sendTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// upload uploads media with the current client within ctx, which comes from
+// sendContext.
+func (s *session) upload(ctx context.Context, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	return s.Client().Upload(ctx, data, mediaType)
+}
+
+// send sends msg with the current client and starts tracking its receipts.
+// Transient failures are retried up to -send-attempts times with a doubling
+// delay, reusing the message id so the recipient sees at most one copy. The
+// number of attempts made is returned alongside the result. The whole of it
+// is limited to -send-timeout on top of ctx, a ctx from sendContext keeps
+// its earlier deadline.
+func (s *session) send(ctx context.Context, to types.JID, msg *proto.Message) (whatsmeow.SendResponse, int, error) {
+	ctx, cancel := sendContext(ctx)
+	defer cancel()
+	extra := whatsmeow.SendRequestExtra{ID: whatsmeow.GenerateMessageID()}
+	backoff := sendBackoff
+	var resp whatsmeow.SendResponse
+	var err error
+	attempts := 0
+	// tracked up front, the delivery receipt may beat SendMessage returning
+	trackSent(to, extra.ID)
+	for {
+		attempts++
+		resp, err = s.Client().SendMessage(ctx, to, msg, extra)
+		if err == nil || attempts >= sendAttempts || !isTransient(err) {
+			break
+		}
+		s.log.Warnf("Error sending message %s (attempt %d), retrying in %s: %s", extra.ID, attempts, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		sendFailures.WithLabelValues(s.name).Inc()
+		forgetSent(extra.ID)
+		s.recordSent(to, extra.ID, msg, statusFailed)
+		return resp, attempts, err
+	}
+	messagesSent.WithLabelValues(s.name).Inc()
+	s.recordSent(to, resp.ID, msg, statusSent)
+	// our own polls do not come back as events, votes need their options
+	if poll := pollCreation(msg); poll != nil {
+		if err := storePoll(resp.ID, poll); err != nil {
+			mainLog.Errorf("Error storing poll %s: %s", resp.ID, err)
+		}
+	}
+	return resp, attempts, nil
+}
+
+// isTransient tells whether a send error comes from the connection rather
+// than from the message itself, only those are worth another attempt.
+func isTransient(err error) bool {
+	var disconnected *whatsmeow.DisconnectedError
+	var netErr net.Error
+	return errors.Is(err, whatsmeow.ErrNotConnected) ||
+		errors.Is(err, whatsmeow.ErrIQTimedOut) ||
+		errors.Is(err, whatsmeow.ErrMessageTimedOut) ||
+		errors.As(err, &disconnected) ||
+		errors.As(err, &netErr)
+}
+
+// connect replaces the current client with a fresh one and connects it.
+func (s *session) connect() error {
+	s.lock.RLock()
+	device := s.device
+	s.lock.RUnlock()
+	cli := whatsmeow.NewClient(device, s.log)
+	cli.AddEventHandler(s.eventHandler(cli))
+	s.lock.Lock()
+	s.client = cli
+	s.presence = ""
+	s.lock.Unlock()
+	err := cli.Connect()
+	if err != nil {
+		return err
+	}
+	if cli.Store.ID != nil {
+		s.setReady(true)
+	}
+	return nil
+}
+
+func (s *session) eventHandler(cli *whatsmeow.Client) func(evt interface{}) {
+	return func(evt interface{}) {
+		switch v := evt.(type) {
+		case *events.Connected:
+			connected.WithLabelValues(s.name).Set(1)
+			s.notifyLifecycle("connected")
+			s.wakeQueue()
+			go s.resubscribePresences()
+		case *events.Disconnected:
+			connected.WithLabelValues(s.name).Set(0)
+			s.notifyLifecycle("disconnected")
+		case *events.StreamError:
+			connected.WithLabelValues(s.name).Set(0)
+			if cli != s.Client() {
+				return
+			}
+			s.setReady(false)
+			s.log.Warnf("Stream error %s on session %s, reconnecting", v.Code, s.name)
+			// most stream errors are transient, the service only goes down
+			// once the session can not be brought back
+			go func() {
+				cli.Disconnect()
+				if !s.reconnect() {
+					s.shutdown()
+				}
+			}()
+		case *events.QR:
+			s.notifyLifecycle("qr")
+			go s.rotateQR(v.Codes)
+		case *events.PairSuccess:
+			s.setReady(true)
+			s.lock.Lock()
+			s.missingDevice = ""
+			s.lock.Unlock()
+			s.log.Infof("Session %s paired as %s", s.name, v.ID)
+		case *events.LoggedOut:
+			s.setReady(false)
+			loggingOut := s.state.Snapshot().LoggingOut
+			current := s.Client()
+			connected.WithLabelValues(s.name).Set(0)
+			s.notifyLifecycle("logged_out")
+			// a user initiated logout reconnects by itself, and events of a
+			// client which has already been replaced are of no interest
+			if loggingOut || cli != current {
+				return
+			}
+			go s.reconnect()
+		case *events.Receipt:
+			trackReceipt(v)
+			go s.recordReceipt(v)
+			s.stream.append("receipt", newReceiptPayload(s, v))
+		case *events.Presence:
+			s.wakePresenceWaiters(v)
+			if webhook != "" {
+				go s.forwardPresence(v)
+			}
+		case *events.Message:
+			if !s.firstDelivery(v) {
+				s.log.Debugf("Skipping message %s delivered again", v.Info.ID)
+				return
+			}
+			if poll := pollCreation(v.Message); poll != nil {
+				if err := storePoll(v.Info.ID, poll); err != nil {
+					mainLog.Errorf("Error storing poll %s: %s", v.Info.ID, err)
+				}
+			}
+			if v.Message.GetPollUpdateMessage() != nil {
+				if webhook != "" && incomingFilter.allows(v) {
+					go s.forwardPollVote(v)
+				}
+				return
+			}
+			payload := newMessagePayload(s, v)
+			post := webhook != "" && incomingFilter.allows(v)
+			// tokens are only issued for payloads somebody gets right away,
+			// events /events replays later come without
+			if post || s.events.listening() || s.stream.listening() {
+				s.addReplyToken(payload, v)
+			}
+			s.events.publish(&eventMessage{Type: "message", messagePayload: payload})
+			s.stream.append("message", payload)
+			if post {
+				go postWebhook(webhook, payload)
+			}
+		}
+	}
+}
+
+// reconnect connects a fresh client, retrying with an exponentially growing
+// and jittered delay. Once -reconnect-attempts are exhausted the session is
+// left logged out and false is returned. Only one reconnect runs at a time,
+// concurrent calls return true right away.
+func (s *session) reconnect() bool {
+	s.lock.Lock()
+	if s.reconnecting {
+		s.lock.Unlock()
+		return true
+	}
+	s.reconnecting = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.reconnecting = false
+		s.lock.Unlock()
+	}()
+	delay := reconnectDelay
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		// up to half of the delay on top, so sessions do not retry in lockstep
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		reconnects.WithLabelValues(s.name).Inc()
+		s.log.Infof("Reconnecting session %s (attempt %d of %d)", s.name, attempt, reconnectAttempts)
+		err := s.connect()
+		if err == nil {
+			return true
+		}
+		mainLog.Errorf("Error reconnecting session %s: %s", s.name, err)
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+	mainLog.Errorf("Giving up reconnecting session %s after %d attempts", s.name, reconnectAttempts)
+	s.setReady(false)
+	s.notifyLifecycle("reconnect_failed")
+	return false
+}
+
+// routeSessions serves /s/{session}/... with the router of the named
+// session, every other path goes to the fallback router.
+func routeSessions(routers map[string]http.Handler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, "/s/")
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		name, path, _ := strings.Cut(rest, "/")
+		router := routers[name]
+		if router == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown session"))
+			return
+		}
+		u := *r.URL
+		u.Path = "/" + path
+		u.RawPath = ""
+		r2 := r.Clone(r.Context())
+		r2.URL = &u
+		router.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// settings are the options which SIGHUP reloads without touching the
+// sessions. They are replaced as a whole, readers take a snapshot with
+// currentSettings and use it for the rest of the request.
+type settings struct {
+	serverKey string
+	keyACLs   []*keyACL
+	templates map[string]string
+	// rate and globalRate are the specs the limiters were made from, an
+	// unchanged spec keeps its limiter and the buckets in it.
+	rate               string
+	globalRate         string
+	destinationLimiter *limiter
+	globalLimiter      *limiter
+}
+
+var activeSettings atomic.Pointer[settings]
+
+func currentSettings() *settings {
+	return activeSettings.Load()
+}
+
+// reloadableFlags are the options re-read on SIGHUP.
+var reloadableFlags = []string{"key", "keys", "templates", "rate", "global-rate"}
+
+// newSettings loads the keys and templates files and builds the limiters,
+// taking over the limiters of previous whose rate has not changed.
+func newSettings(key, keys, templates, rate, globalRate string, previous *settings) (*settings, error) {
+	next := &settings{serverKey: key, rate: rate, globalRate: globalRate}
+	var err error
+	if keys != "" {
+		if next.keyACLs, err = loadKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+	if templates != "" {
+		if next.templates, err = loadTemplates(templates); err != nil {
+			return nil, err
+		}
+	}
+	if previous != nil && previous.rate == rate {
+		next.destinationLimiter = previous.destinationLimiter
+	} else if next.destinationLimiter, err = parseRate(rate); err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.globalRate == globalRate {
+		next.globalLimiter = previous.globalLimiter
+	} else if next.globalLimiter, err = parseRate(globalRate); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// reloadSettings reads the reloadable options again with the precedence of
+// applyConfig, command line flags stay as they are, and swaps them in. The
+// current settings are kept if anything is invalid.
+func reloadSettings() error {
+	config, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	values := make(map[string]string, len(reloadableFlags))
+	for _, name := range reloadableFlags {
+		f := flag.Lookup(name)
+		value, ok := f.Value.String(), explicit[name]
+		if !ok {
+			value, ok = os.LookupEnv(envName(name))
+		}
+		if !ok {
+			if v, found := config[name]; found {
+				value = fmt.Sprint(v)
+			} else {
+				value = f.DefValue
+			}
+		}
+		values[name] = value
+	}
+	next, err := newSettings(values["key"], values["keys"], values["templates"], values["rate"], values["global-rate"], currentSettings())
+	if err != nil {
+		return err
+	}
+	activeSettings.Store(next)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	// eventLogSize is how many events /events keeps for clients which
+	// reconnect with Last-Event-ID.
+	eventLogSize     = 256
+	sseKeepAlive     = 30 * time.Second
+	sseRetryInterval = 3 * time.Second
+)
+
+type loggedEvent struct {
+	id   int64
+	kind string
+	data []byte
+}
+
+// eventLog keeps the latest messages and receipts of a session for /events,
+// numbered so reconnecting clients can resume where they left off.
+type eventLog struct {
+	lock    sync.Mutex
+	last    int64
+	entries []loggedEvent
+	// clients is how many /events streams are open.
+	clients int
+	// wake is closed and replaced whenever an event is appended.
+	wake chan struct{}
+}
+
+func (l *eventLog) append(kind string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		mainLog.Errorf("Error encoding event: %s", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.last++
+	l.entries = append(l.entries, loggedEvent{id: l.last, kind: kind, data: data})
+	if len(l.entries) > eventLogSize {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-eventLogSize:]...)
+	}
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// listening reports whether any /events client is connected.
+func (l *eventLog) listening() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.clients > 0
+}
+
+func (l *eventLog) connect() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.clients++
+}
+
+func (l *eventLog) disconnect() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.clients--
+}
+
+// since returns the events after id and a channel closed by the next one.
+// An id ahead of the log comes from before a restart, all the events are
+// new to that client.
+func (l *eventLog) since(id int64) ([]loggedEvent, chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if id > l.last {
+		id = 0
+	}
+	var pending []loggedEvent
+	for _, entry := range l.entries {
+		if entry.id > id {
+			pending = append(pending, entry)
+		}
+	}
+	if l.wake == nil {
+		l.wake = make(chan struct{})
+	}
+	return pending, l.wake
+}
+
+type receiptPayload struct {
+	Session   string   `json:"session"`
+	Chat      string   `json:"chat"`
+	Sender    string   `json:"sender"`
+	IDs       []string `json:"ids"`
+	Type      string   `json:"type"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+func newReceiptPayload(s *session, evt *events.Receipt) *receiptPayload {
+	kind := string(evt.Type)
+	if kind == "" {
+		kind = statusDelivered
+	}
+	return &receiptPayload{
+		Session:   s.name,
+		Chat:      evt.Chat.String(),
+		Sender:    evt.Sender.String(),
+		IDs:       evt.MessageIDs,
+		Type:      kind,
+		Timestamp: evt.Timestamp.Unix(),
+	}
+}
+
+// handleEventStream streams the incoming messages and receipts of the
+// session as server-sent events. Browsers reconnect with Last-Event-ID by
+// themselves and get the events they missed, as far as the log goes back.
+func handleEventStream(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(sess, r, r.URL.Query().Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		var last int64
+		if value := r.Header.Get("Last-Event-ID"); value != "" {
+			var err error
+			if last, err = strconv.ParseInt(value, 10, 64); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("invalid Last-Event-ID"))
+				return
+			}
+		}
+		controller := http.NewResponseController(w)
+		// the stream outlives -write-timeout, the keep-alives notice dead
+		// clients instead
+		_ = controller.SetWriteDeadline(time.Time{})
+		header := w.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, "retry: %d\n\n", sseRetryInterval.Milliseconds())
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+		sess.stream.connect()
+		defer sess.stream.disconnect()
+		for {
+			pending, wake := sess.stream.since(last)
+			for _, event := range pending {
+				_, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.kind, event.data)
+				last = event.id
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+			select {
+			case <-wake:
+			case <-keepAlive.C:
+				// a comment keeps proxies from closing an idle stream
+				_, _ = w.Write([]byte(": keep-alive\n\n"))
+			case <-r.Context().Done():
+				return
+			case <-shuttingDown:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionState is the login state of a session, its methods take care of
+// the locking.
+type sessionState struct {
+	lock   sync.RWMutex
+	ready  bool
+	qrCode string
+	// qrExpires is when qrCode gets replaced by the next code, qrGeneration
+	// stops the rotation of codes which are no longer relevant.
+	qrExpires    time.Time
+	qrGeneration int
+	// qrIndex is the position of qrCode among the qrTotal codes of its
+	// generation, qrAdvance asks the rotation for the next one early.
+	qrIndex   int
+	qrTotal   int
+	qrAdvance chan struct{}
+	// qrExpired is set when the last code ran out without being scanned and
+	// -qr-expiry is expire.
+	qrExpired bool
+	// loggingOut is set while a logout requested over HTTP is in progress,
+	// so the LoggedOut event handler leaves the reconnect to the requester.
+	loggingOut bool
+	// pairPhone and pairCode hold the pending phone number pairing request,
+	// alongside the QR code which stays valid until either of them is used.
+	pairPhone string
+	pairCode  string
+	// changed is closed and replaced whenever the login state changes, see
+	// Watch.
+	changed chan struct{}
+}
+
+// stateSnapshot is a consistent copy of a sessionState.
+type stateSnapshot struct {
+	Ready      bool
+	QRCode     string
+	QRExpires  time.Time
+	QRExpired  bool
+	QRIndex    int
+	QRTotal    int
+	LoggingOut bool
+	PairPhone  string
+	PairCode   string
+}
+
+func (st *sessionState) Snapshot() stateSnapshot {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.snapshot()
+}
+
+// snapshot copies the state, the lock must be held.
+func (st *sessionState) snapshot() stateSnapshot {
+	return stateSnapshot{
+		Ready:      st.ready,
+		QRCode:     st.qrCode,
+		QRExpires:  st.qrExpires,
+		QRExpired:  st.qrExpired,
+		QRIndex:    st.qrIndex,
+		QRTotal:    st.qrTotal,
+		LoggingOut: st.loggingOut,
+		PairPhone:  st.pairPhone,
+		PairCode:   st.pairCode,
+	}
+}
+
+// Watch returns a snapshot along with a channel which is closed once the
+// state changes after it.
+func (st *sessionState) Watch() (stateSnapshot, <-chan struct{}) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.changed == nil {
+		st.changed = make(chan struct{})
+	}
+	return st.snapshot(), st.changed
+}
+
+// notify wakes up the watchers, the lock must be held.
+func (st *sessionState) notify() {
+	if st.changed != nil {
+		close(st.changed)
+		st.changed = nil
+	}
+}
+
+// SetReady ends the pending login, either way the current QR code and
+// pairing code are of no use anymore. It returns whether ready changed.
+func (st *sessionState) SetReady(ready bool) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	changed := st.ready != ready
+	st.ready = ready
+	st.qrCode = ""
+	st.qrExpired = false
+	st.qrGeneration++
+	st.pairPhone = ""
+	st.pairCode = ""
+	st.notify()
+	return changed
+}
+
+// NewQRGeneration invalidates the QR codes being rotated and returns the
+// generation for the total codes to come, along with the channel AdvanceQR
+// signals on.
+func (st *sessionState) NewQRGeneration(total int) (int, <-chan struct{}) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.qrGeneration++
+	st.qrExpired = false
+	st.qrTotal = total
+	st.qrAdvance = make(chan struct{}, 1)
+	return st.qrGeneration, st.qrAdvance
+}
+
+// SetQR replaces the QR code with the one at index if generation is still
+// the current one, it returns false otherwise.
+func (st *sessionState) SetQR(generation int, index int, code string, expires time.Time) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.qrGeneration != generation {
+		return false
+	}
+	st.qrCode = code
+	st.qrIndex = index
+	st.qrExpires = expires
+	st.notify()
+	return true
+}
+
+// AdvanceQR asks the rotation to move on to the next code, it returns false
+// if there is no code shown or it is the last one.
+func (st *sessionState) AdvanceQR() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.qrCode == "" || st.qrIndex+1 >= st.qrTotal {
+		return false
+	}
+	select {
+	case st.qrAdvance <- struct{}{}:
+	default:
+		// already asked for and not taken yet
+	}
+	return true
+}
+
+// ExpireQR clears the QR code once the last one of generation ran out, with
+// expired the code is reported as expired rather than not available yet. It
+// returns false if generation is not the current one anymore.
+func (st *sessionState) ExpireQR(generation int, expired bool) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.qrGeneration != generation {
+		return false
+	}
+	st.qrCode = ""
+	st.qrExpires = time.Time{}
+	st.qrExpired = expired
+	st.notify()
+	return true
+}
+
+// TakeQRExpired clears the expired QR state, it returns false if the codes
+// had not expired or somebody else took them already.
+func (st *sessionState) TakeQRExpired() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	expired := st.qrExpired
+	st.qrExpired = false
+	return expired
+}
+
+// SetPairing remembers the pairing code requested for phone.
+func (st *sessionState) SetPairing(phone string, code string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.pairPhone = phone
+	st.pairCode = code
+}
+
+// BeginLogout marks a logout as in progress, it returns false if the session
+// is not logged in or another logout is already running.
+func (st *sessionState) BeginLogout() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if !st.ready || st.loggingOut {
+		return false
+	}
+	st.loggingOut = true
+	return true
+}
+
+func (st *sessionState) EndLogout() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.loggingOut = false
+}
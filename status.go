@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	statusSent      = "sent"
+	statusDelivered = "delivered"
+	statusRead      = "read"
+)
+
+// statusRank orders the statuses so a late delivery receipt never
+// downgrades a message which has already been read.
+var statusRank = map[string]int{
+	statusSent:      0,
+	statusDelivered: 1,
+	statusRead:      2,
+}
+
+type messageStatus struct {
+	chat      types.JID
+	status    string
+	sent      time.Time
+	updated   time.Time
+	delivered time.Time
+}
+
+// statuses keeps the latest known status of the messages sent by the
+// service, entries are dropped once they are older than statusTTL. waiters
+// are the sends of waitDelivered waiting for the first delivery receipt.
+var statuses = struct {
+	lock    sync.Mutex
+	byID    map[types.MessageID]*messageStatus
+	waiters map[types.MessageID][]chan time.Time
+}{byID: map[types.MessageID]*messageStatus{}, waiters: map[types.MessageID][]chan time.Time{}}
+
+func trackSent(chat types.JID, id types.MessageID) {
+	statuses.lock.Lock()
+	defer statuses.lock.Unlock()
+	now := time.Now()
+	statuses.byID[id] = &messageStatus{chat: chat, status: statusSent, sent: now, updated: now}
+}
+
+// forgetSent drops the entry of a message which could not be sent after all.
+func forgetSent(id types.MessageID) {
+	statuses.lock.Lock()
+	defer statuses.lock.Unlock()
+	delete(statuses.byID, id)
+}
+
+func trackReceipt(evt *events.Receipt) {
+	var status string
+	switch evt.Type {
+	case types.ReceiptTypeDelivered:
+		status = statusDelivered
+	case types.ReceiptTypeRead, types.ReceiptTypePlayed:
+		status = statusRead
+	default:
+		return
+	}
+	statuses.lock.Lock()
+	defer statuses.lock.Unlock()
+	for _, id := range evt.MessageIDs {
+		entry, ok := statuses.byID[id]
+		if !ok || statusRank[entry.status] >= statusRank[status] {
+			continue
+		}
+		if entry.delivered.IsZero() {
+			// a read receipt stands in for a delivery receipt never seen
+			entry.delivered = evt.Timestamp
+			for _, ch := range statuses.waiters[id] {
+				ch <- evt.Timestamp
+			}
+			delete(statuses.waiters, id)
+		}
+		entry.status = status
+		entry.updated = time.Now()
+	}
+}
+
+// waitDelivered blocks until a receipt shows the message reached a device of
+// the recipient and returns when it did, it returns false if that did not
+// happen before ctx is done.
+func waitDelivered(ctx context.Context, id types.MessageID) (time.Time, bool) {
+	ch := make(chan time.Time, 1)
+	statuses.lock.Lock()
+	if entry, ok := statuses.byID[id]; ok && !entry.delivered.IsZero() {
+		statuses.lock.Unlock()
+		return entry.delivered, true
+	}
+	statuses.waiters[id] = append(statuses.waiters[id], ch)
+	statuses.lock.Unlock()
+	select {
+	case delivered := <-ch:
+		return delivered, true
+	case <-ctx.Done():
+	}
+	statuses.lock.Lock()
+	defer statuses.lock.Unlock()
+	waiters := statuses.waiters[id]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(statuses.waiters, id)
+	} else {
+		statuses.waiters[id] = waiters
+	}
+	// the receipt may have arrived while giving up
+	select {
+	case delivered := <-ch:
+		return delivered, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func lookupStatus(id types.MessageID) (string, bool) {
+	statuses.lock.Lock()
+	defer statuses.lock.Unlock()
+	entry, ok := statuses.byID[id]
+	if !ok || time.Since(entry.updated) > statusTTL {
+		return "", false
+	}
+	return entry.status, true
+}
+
+// lookupSent tells when the message was sent by the service to chat.
+func lookupSent(chat types.JID, id types.MessageID) (time.Time, bool) {
+	statuses.lock.Lock()
+	defer statuses.lock.Unlock()
+	entry, ok := statuses.byID[id]
+	if !ok || entry.chat != chat || time.Since(entry.updated) > statusTTL {
+		return time.Time{}, false
+	}
+	return entry.sent, true
+}
+
+// expireStatuses periodically drops the entries older than statusTTL.
+func expireStatuses() {
+	for range time.Tick(time.Minute) {
+		statuses.lock.Lock()
+		for id, entry := range statuses.byID {
+			if time.Since(entry.updated) > statusTTL {
+				delete(statuses.byID, id)
+			}
+		}
+		statuses.lock.Unlock()
+	}
+}
+
+func handleStatus(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if authorize(sess, r, r.Form.Get("key")) == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		id := r.Form.Get("id")
+		if id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("id is required"))
+			return
+		}
+		status, ok := lookupStatus(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown message id"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":     id,
+			"status": status,
+		})
+	}
+}
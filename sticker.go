@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// pngToSticker converts a PNG image to a 512x512 WebP sticker, padding it
+// with transparency to keep the aspect ratio.
+func pngToSticker(ctx context.Context, data []byte) ([]byte, error) {
+	return ffmpeg(ctx, data,
+		"-vf", "scale=512:512:force_original_aspect_ratio=decrease,format=rgba,pad=512:512:(ow-iw)/2:(oh-ih)/2:color=0x00000000",
+		"-c:v", "libwebp", "-lossless", "1", "-f", "webp")
+}
+
+func handleSendSticker(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		data, _, err := readMedia(r, "sticker", req.Sticker)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		switch http.DetectContentType(data) {
+		case "image/webp":
+		case "image/png":
+			data, err = pngToSticker(r.Context(), data)
+			if err != nil {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				_, _ = w.Write([]byte("failed to convert the PNG image to WebP: " + err.Error()))
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = w.Write([]byte("stickers must be WebP or PNG images"))
+			return
+		}
+		ctx, cancel := sendContext(r.Context())
+		defer cancel()
+		uploaded, err := sess.upload(ctx, data, whatsmeow.MediaImage)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		sticker := &proto.StickerMessage{
+			Url:           gproto.String(uploaded.URL),
+			DirectPath:    gproto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      gproto.String("image/webp"),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    gproto.Uint64(uploaded.FileLength),
+		}
+		resp, attempts, err := sess.send(ctx, jid, &proto.Message{StickerMessage: sticker})
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		writeSendResponse(w, resp)
+	}
+}
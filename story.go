@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// defaultStatusBackground is the background of text statuses without a
+// backgroundColor, the dark teal WhatsApp picks itself.
+const defaultStatusBackground = 0xff075e54
+
+// statusColor parses colors such as "#075e54" or "#ff075e54" into ARGB,
+// colors without an alpha channel are opaque.
+func statusColor(color string) (uint32, error) {
+	hex := strings.TrimPrefix(color, "#")
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 && len(hex) != 8 {
+		return 0, fmt.Errorf("invalid color %q, expected #rrggbb or #aarrggbb", color)
+	}
+	if len(hex) == 6 {
+		value |= 0xff000000
+	}
+	return uint32(value), nil
+}
+
+// handleSendStatus posts a text or image status update. WhatsApp sends it to
+// status@broadcast, whatsmeow fans it out to the contacts allowed by the
+// status privacy settings of the account. Text statuses are extended text
+// messages carrying their colors and font, plain conversations show up
+// unstyled.
+func handleSendStatus(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sess.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		req, err := readSendRequest(r)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		acl := authorize(sess, r, req.Key)
+		if acl == nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("403 Forbidden"))
+			return
+		}
+		if !acl.allowsDestination(types.StatusBroadcastJID) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("destination not allowed for this key"))
+			return
+		}
+		ctx, cancel := sendContext(r.Context())
+		defer cancel()
+		var msg *proto.Message
+		if req.Image != "" || r.MultipartForm != nil && r.MultipartForm.File["image"] != nil {
+			data, _, err := readMedia(r, "image", req.Image)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			image, err := sess.uploadImage(ctx, data, req.Caption)
+			if err != nil {
+				writeSendError(w, err)
+				return
+			}
+			msg = &proto.Message{ImageMessage: image}
+		} else {
+			if req.Text == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("text or image is required"))
+				return
+			}
+			text := &proto.ExtendedTextMessage{
+				Text:           gproto.String(req.Text),
+				TextArgb:       gproto.Uint32(0xffffffff),
+				BackgroundArgb: gproto.Uint32(defaultStatusBackground),
+				Font:           proto.ExtendedTextMessage_SYSTEM.Enum(),
+			}
+			if req.BackgroundColor != "" {
+				background, err := statusColor(req.BackgroundColor)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(err.Error()))
+					return
+				}
+				text.BackgroundArgb = gproto.Uint32(background)
+			}
+			if req.Font != "" {
+				font, ok := proto.ExtendedTextMessage_FontType_value[strings.ToUpper(req.Font)]
+				if !ok {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte("unknown font " + req.Font))
+					return
+				}
+				text.Font = proto.ExtendedTextMessage_FontType(font).Enum()
+			}
+			msg = &proto.Message{ExtendedTextMessage: text}
+		}
+		resp, attempts, err := sess.send(ctx, types.StatusBroadcastJID, msg)
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		writeSendResponse(w, resp)
+	}
+}
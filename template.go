@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// templateVariable matches the {{name}} placeholders of a template.
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// loadTemplates reads the JSON or YAML map of template names to their text,
+// by file extension.
+func loadTemplates(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var templates map[string]string
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &templates)
+	default:
+		err = json.Unmarshal(data, &templates)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid templates file %s: %w", file, err)
+	}
+	return templates, nil
+}
+
+// renderTemplate fills in the placeholders of text from vars, it returns the
+// names of the variables which are missing instead when there are any.
+func renderTemplate(text string, vars map[string]string) (string, []string) {
+	var missing []string
+	seen := make(map[string]bool)
+	rendered := templateVariable.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := templateVariable.FindStringSubmatch(placeholder)[1]
+		value, ok := vars[name]
+		if !ok && !seen[name] {
+			missing = append(missing, name)
+		}
+		seen[name] = true
+		return value
+	})
+	return rendered, missing
+}
+
+// handleSendTemplate sends the template of -templates called name, with its
+// variables taken from vars.
+func handleSendTemplate(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, acl, ok := readSend(sess, w, r, true)
+		if !ok {
+			return
+		}
+		if len(req.To) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("this endpoint sends to a single recipient only"))
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			// JSON bodies may still name the template in the query
+			name = strings.TrimSpace(r.URL.Query().Get("name"))
+		}
+		if name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("name is required"))
+			return
+		}
+		template, ok := currentSettings().templates[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("unknown template " + name))
+			return
+		}
+		text, missing := renderTemplate(template, req.Vars)
+		if len(missing) > 0 {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"error":   "missing template variables",
+				"missing": missing,
+			})
+			return
+		}
+		req.Text = text
+		if _, err := mentionedJIDs(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		jid, ok := sess.target(w, acl, req)
+		if !ok {
+			return
+		}
+		msg, err := textMessage(jid, req, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		deliver(w, r, sess, jid, msg)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"go.mau.fi/whatsmeow/store"
+)
+
+// version is the release of the service, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// moduleVersion returns the version of a dependency compiled into the
+// binary, or "unknown" when the build info is missing.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// handleVersion reports the versions of the build, it needs no key.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version":   version,
+		"whatsmeow": moduleVersion("go.mau.fi/whatsmeow"),
+		"waWeb":     store.GetWAVersion().String(),
+		"go":        runtime.Version(),
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// maxVideoSize is the largest video WhatsApp accepts.
+const maxVideoSize = 16 << 20
+
+// ffmpeg runs ffmpeg with data as its input file, args are the options
+// after the input, and returns what it writes to its standard output. It is
+// killed once ctx is done, so a client going away does not leave it running.
+func ffmpeg(ctx context.Context, data []byte, args ...string) ([]byte, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, err
+	}
+	// mp4 files often keep their index at the end, so ffmpeg needs a file it
+	// can seek in rather than a pipe
+	file, err := os.CreateTemp("", "waservice-media-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, append([]string{"-loglevel", "error", "-i", file.Name()}, append(args, "pipe:1")...)...)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if out.Len() == 0 {
+		return nil, errors.New("ffmpeg produced no output")
+	}
+	return out.Bytes(), nil
+}
+
+// videoThumbnail grabs the first frame of a video as a small JPEG.
+func videoThumbnail(ctx context.Context, data []byte) ([]byte, error) {
+	return ffmpeg(ctx, data, "-frames:v", "1", "-vf", "scale=320:-2", "-f", "image2", "-c:v", "mjpeg")
+}
+
+// gifToMP4 converts an animated GIF to the MP4 WhatsApp plays GIFs as. The
+// output is fragmented since ffmpeg can not seek back in a pipe to write the
+// index, and the size is rounded down to even for H.264.
+func gifToMP4(ctx context.Context, data []byte) ([]byte, error) {
+	return ffmpeg(ctx, data,
+		"-an", "-movflags", "frag_keyframe+empty_moov", "-pix_fmt", "yuv420p",
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-c:v", "libx264", "-f", "mp4")
+}
+
+func handleSendVideo(sess *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, jid, ok := prepareSend(sess, w, r, false)
+		if !ok {
+			return
+		}
+		data, _, err := readMedia(r, "video", req.Video)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if len(data) > maxVideoSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = w.Write([]byte(fmt.Sprintf("video exceeds %d bytes", maxVideoSize)))
+			return
+		}
+		mimetype := req.Mimetype
+		if mimetype == "" {
+			mimetype = http.DetectContentType(data)
+		}
+		if req.GIF && mimetype == "image/gif" {
+			// WhatsApp does not take GIF bytes, only MP4 flagged for playback
+			if data, err = gifToMP4(r.Context(), data); err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = w.Write([]byte("error converting GIF: " + err.Error()))
+				return
+			}
+			mimetype = "video/mp4"
+		}
+		if req.GIF && mimetype != "video/mp4" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = w.Write([]byte("gif needs an MP4 video or a GIF image, got " + mimetype))
+			return
+		}
+		if !strings.HasPrefix(mimetype, "video/") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = w.Write([]byte("unsupported video type " + mimetype))
+			return
+		}
+		var thumbnail []byte
+		if req.Thumbnail != "" || r.MultipartForm != nil && r.MultipartForm.File["thumbnail"] != nil {
+			thumbnail, _, err = readMedia(r, "thumbnail", req.Thumbnail)
+			if err == nil && http.DetectContentType(thumbnail) != "image/jpeg" {
+				err = errors.New("thumbnail must be a JPEG image")
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+		} else if thumbnail, err = videoThumbnail(r.Context(), data); err != nil {
+			// the video still plays, it just shows up without a preview
+			sess.log.Warnf("Error generating video thumbnail: %s", err)
+		}
+		ctx, cancel := sendContext(r.Context())
+		defer cancel()
+		uploaded, err := sess.upload(ctx, data, whatsmeow.MediaVideo)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		video := &proto.VideoMessage{
+			Url:           gproto.String(uploaded.URL),
+			DirectPath:    gproto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      gproto.String(mimetype),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    gproto.Uint64(uploaded.FileLength),
+			JpegThumbnail: thumbnail,
+		}
+		if req.GIF {
+			video.GifPlayback = gproto.Bool(true)
+		}
+		if req.Caption != "" {
+			video.Caption = gproto.String(req.Caption)
+		}
+		resp, attempts, err := sess.send(ctx, jid, &proto.Message{VideoMessage: video})
+		setAttempts(w, attempts)
+		if err != nil {
+			writeSendError(w, err)
+			return
+		}
+		writeSendResponse(w, resp)
+	}
+}
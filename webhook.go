@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const webhookAttempts = 5
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type messagePayload struct {
+	Session   string `json:"session"`
+	ID        string `json:"id"`
+	Chat      string `json:"chat"`
+	Sender    string `json:"sender"`
+	PushName  string `json:"pushName"`
+	Timestamp int64  `json:"timestamp"`
+	IsGroup   bool   `json:"isGroup"`
+	IsFromMe  bool   `json:"isFromMe"`
+	Text      string `json:"text,omitempty"`
+	Caption   string `json:"caption,omitempty"`
+	// ButtonID is the id of the button tapped in reply to /send/buttons,
+	// Text holds its label then.
+	ButtonID string `json:"buttonId,omitempty"`
+	// RowID is the id of the row selected in reply to /send/list, Text
+	// holds its title then.
+	RowID string `json:"rowId,omitempty"`
+	// Media refers to the attachment of the message, it can be passed on to
+	// /media/download as is.
+	Media *mediaRef `json:"media,omitempty"`
+	// ReplyToken can be passed to /send instead of to, the reply quotes
+	// this message. Only payloads delivered as the message arrived have one.
+	ReplyToken string `json:"replyToken,omitempty"`
+}
+
+func newMessagePayload(s *session, evt *events.Message) *messagePayload {
+	text, caption := messageText(evt.Message)
+	payload := &messagePayload{
+		Session:   s.name,
+		ID:        evt.Info.ID,
+		Chat:      evt.Info.Chat.String(),
+		Sender:    evt.Info.Sender.String(),
+		PushName:  evt.Info.PushName,
+		Timestamp: evt.Info.Timestamp.Unix(),
+		IsGroup:   evt.Info.IsGroup,
+		IsFromMe:  evt.Info.IsFromMe,
+		Text:      text,
+		Caption:   caption,
+		Media:     newMediaRef(evt.Message),
+	}
+	switch {
+	case evt.Message.GetButtonsResponseMessage() != nil:
+		payload.ButtonID = evt.Message.GetButtonsResponseMessage().GetSelectedButtonId()
+	case evt.Message.GetTemplateButtonReplyMessage() != nil:
+		payload.ButtonID = evt.Message.GetTemplateButtonReplyMessage().GetSelectedId()
+	case evt.Message.GetListResponseMessage() != nil:
+		payload.RowID = evt.Message.GetListResponseMessage().GetSingleSelectReply().GetSelectedRowId()
+	}
+	return payload
+}
+
+// webhookFilter decides which incoming messages are posted to the webhook,
+// from -webhook-allow and -webhook-block. Entries are patterns matched
+// against the chat JID or its user part, such as "*@broadcast", or with a
+// type: prefix against the kind of message, such as "type:reaction".
+type webhookFilter struct {
+	allowChats, allowTypes []string
+	blockChats, blockTypes []string
+}
+
+var incomingFilter webhookFilter
+
+// newWebhookFilter parses the comma separated allow and block lists.
+func newWebhookFilter(allow string, block string) (webhookFilter, error) {
+	var f webhookFilter
+	split := func(list string, chats *[]string, types *[]string) error {
+		for _, entry := range splitList(list) {
+			target := chats
+			if kind, ok := strings.CutPrefix(entry, "type:"); ok {
+				entry, target = kind, types
+			}
+			if _, err := path.Match(entry, ""); err != nil {
+				return fmt.Errorf("invalid webhook filter %q: %w", entry, err)
+			}
+			*target = append(*target, entry)
+		}
+		return nil
+	}
+	if err := split(allow, &f.allowChats, &f.allowTypes); err != nil {
+		return f, err
+	}
+	err := split(block, &f.blockChats, &f.blockTypes)
+	return f, err
+}
+
+// allows tells whether the message is to be posted, a message has to pass
+// both kinds of allow entries if there are any and match no block entry.
+func (f *webhookFilter) allows(evt *events.Message) bool {
+	chat := evt.Info.Chat.ToNonAD()
+	kind := messageKind(evt.Message)
+	matchChat := func(patterns []string) bool {
+		return matchAny(patterns, chat.String()) || matchAny(patterns, chat.User)
+	}
+	if !matchChat(f.allowChats) || !matchAny(f.allowTypes, kind) {
+		return false
+	}
+	if len(f.blockChats) > 0 && matchChat(f.blockChats) {
+		return false
+	}
+	return len(f.blockTypes) == 0 || !matchAny(f.blockTypes, kind)
+}
+
+// lifecyclePayload notifies -lifecycle-webhook of a change in the connection
+// of a session, Type is one of connected, disconnected, logged_out, qr or
+// reconnect_failed.
+type lifecyclePayload struct {
+	Type      string `json:"type"`
+	Session   string `json:"session"`
+	JID       string `json:"jid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// notifyLifecycle posts a lifecycle event of the session if the webhook is
+// configured, and passes it on to the websocket clients.
+func (s *session) notifyLifecycle(kind string) {
+	if lifecycleWebhook == "" && !s.events.listening() {
+		return
+	}
+	payload := &lifecyclePayload{
+		Type:      kind,
+		Session:   s.name,
+		Timestamp: time.Now().Unix(),
+	}
+	if cli := s.Client(); cli != nil && cli.Store.ID != nil {
+		payload.JID = cli.Store.ID.String()
+	}
+	s.events.publish(payload)
+	if lifecycleWebhook != "" {
+		go postWebhook(lifecycleWebhook, payload)
+	}
+}
+
+// messageText extracts the text body or the media caption of a message.
+func messageText(msg *proto.Message) (text string, caption string) {
+	switch {
+	case msg.GetConversation() != "":
+		text = msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		text = msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		caption = msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		caption = msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		caption = msg.GetDocumentMessage().GetCaption()
+	case msg.GetButtonsResponseMessage() != nil:
+		text = msg.GetButtonsResponseMessage().GetSelectedDisplayText()
+	case msg.GetTemplateButtonReplyMessage() != nil:
+		text = msg.GetTemplateButtonReplyMessage().GetSelectedDisplayText()
+	case msg.GetListResponseMessage() != nil:
+		text = msg.GetListResponseMessage().GetTitle()
+	}
+	return
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of body keyed with the
+// server key, sent as X-Signature so receivers can verify the origin.
+func signPayload(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(currentSettings().serverKey))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook delivers payload to url as JSON, retrying with exponential
+// backoff until a 2xx response is received or the attempts are exhausted.
+func postWebhook(url string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		mainLog.Errorf("Error encoding webhook payload: %s", err)
+		return
+	}
+	signature := signPayload(body)
+	delay := time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = sendWebhook(url, body, signature)
+		if err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	mainLog.Errorf("Error delivering webhook after %d attempts: %s", webhookAttempts, err)
+}
+
+func sendWebhook(url string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}